@@ -0,0 +1,63 @@
+package pypihub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func bearerToken(req *http.Request) string {
+	var h = req.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+func (r *Router) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var admin, err = r.config.adminToken.Value()
+		if err != nil {
+			slog.ErrorContext(req.Context(), "error reading admin token", "error", err)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "admin token unavailable"})
+			return
+		}
+		var token = bearerToken(req)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(admin)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer realm=\"pypihub admin\"")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, req)
+	}
+}
+
+func (r *Router) handleAdminRefresh(w http.ResponseWriter, req *http.Request) {
+	var results []SyncResult
+	var repo = req.URL.Query().Get("repo")
+	if repo != "" {
+		if !r.syncer.HasRepo(repo) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown repo " + repo})
+			return
+		}
+		results = []SyncResult{r.syncer.SyncRepo(repo)}
+	} else {
+		results = r.syncer.SyncAll()
+	}
+
+	var status = http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			status = http.StatusBadGateway
+		}
+	}
+	writeJSON(w, status, map[string][]SyncResult{"repos": results})
+}
@@ -0,0 +1,411 @@
+package pypihub
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sdistName returns the file name of the sdist of a project version without
+// its extension, normalized as per PEP 625, e.g. 'flask_env-1.0' for flask-env 1.0
+func sdistName(project string, version string) string {
+	return strings.ToLower(projectNameSeparators.ReplaceAllString(project, "_")) + "-" + version
+}
+
+// sdistPkgInfo builds the PKG-INFO of the sdist a from the static metadata in
+// its top level files, the version always being the one of the asset
+func sdistPkgInfo(a Asset, files map[string][]byte) []byte {
+	var md, err = staticMetadata(files)
+	if err != nil {
+		slog.Warn("error reading static package metadata", "asset", a.URL(), "error", err)
+	}
+	if md == nil {
+		md = &Metadata{}
+	}
+	if md.Name == "" {
+		md.Name = projectName(a)
+	}
+	md.Version = a.Version
+	return formatCoreMetadata(md)
+}
+
+// rewriteArchive copies the gzipped tar archive GitHub made of a tag from r to
+// w, rooting it at the name of the asset a instead of 'owner-repo-<sha>/'. Only
+// the files below a.Subdir are kept, and sdists get a generated PKG-INFO
+// unless they have one, e.g. 'owner-repo-<sha>/packages/foo/setup.py' -> 'foo-1.0/setup.py'
+func rewriteArchive(w io.Writer, r io.Reader, a Asset) error {
+	var gr, err = gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	var root = strings.TrimSuffix(a.Name, ".tar.gz")
+	// rename returns the new name of a path in the archive, or false when it
+	// is outside of a.Subdir
+	var rename = func(name string) (string, bool) {
+		// Drop the directory GitHub roots archives at
+		var p = strings.SplitN(strings.TrimPrefix(name, "./"), "/", 2)
+		if len(p) != 2 {
+			return "", false
+		}
+		var rest = p[1]
+		if a.Subdir != "" {
+			if rest != a.Subdir && rest != a.Subdir+"/" && !strings.HasPrefix(rest, a.Subdir+"/") {
+				return "", false
+			}
+			rest = strings.TrimPrefix(strings.TrimPrefix(rest, a.Subdir), "/")
+		}
+		return path.Join(root, rest), true
+	}
+
+	var gw = gzip.NewWriter(w)
+	var tr = tar.NewReader(gr)
+	var tw = tar.NewWriter(gw)
+	var found = false
+	// The top level files metadata is read from, how much of them aren't
+	// metadata files, and when the archive was made
+	var files = make(map[string][]byte)
+	var kept int64
+	var modTime time.Time
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		var name, ok = rename(hdr.Name)
+		if !ok {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			// Hard links refer to other paths in the archive
+			if hdr.Linkname, ok = rename(hdr.Linkname); !ok {
+				continue
+			}
+		}
+		if !found {
+			found = true
+			modTime = hdr.ModTime
+		}
+		hdr.Name = name
+		// Let the writer pick a format which fits the new names
+		hdr.Format = tar.FormatUnknown
+		delete(hdr.PAXRecords, "path")
+		delete(hdr.PAXRecords, "linkpath")
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		var rel = strings.TrimPrefix(name, root+"/")
+		var metadataFile = isMetadataFile(rel) && hdr.Size <= metadataMaxFileSize
+		var referencedFile = !isMetadataFile(rel) && !strings.Contains(rel, "/") && keepReferencedFile(hdr.Size, kept)
+		if a.Sdist && (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) && (metadataFile || referencedFile) {
+			var data []byte
+			if data, err = ioutil.ReadAll(tr); err != nil {
+				return err
+			}
+			files[rel] = data
+			if referencedFile {
+				kept += hdr.Size
+			}
+			_, err = tw.Write(data)
+		} else {
+			_, err = io.Copy(tw, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !found && a.Subdir == "" {
+		return fmt.Errorf("archive is empty")
+	}
+	if !found {
+		return fmt.Errorf("archive has no %s directory", a.Subdir)
+	}
+
+	if _, ok := files["PKG-INFO"]; a.Sdist && !ok {
+		var data = sdistPkgInfo(a, files)
+		err = tw.WriteHeader(&tar.Header{
+			Name:     root + "/PKG-INFO",
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+type archiveSum struct {
+	size   int
+	sha256 string
+}
+
+// archiveCache keeps rewritten tag archives on disk, so every archive is only
+// rewritten once and keeps the same contents and hash even when GitHub's
+// archive of the tag changes
+type archiveCache struct {
+	dir string
+
+	mu sync.Mutex
+	// sums maps the path of cached archives to their size and hash
+	sums map[string]archiveSum
+}
+
+func newArchiveCache(dir string) *archiveCache {
+	return &archiveCache{
+		dir:  dir,
+		sums: make(map[string]archiveSum),
+	}
+}
+
+// repoDir returns the directory the rewritten archives of owner/repo are cached in
+func (c *archiveCache) repoDir(owner string, repo string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(repoOf(owner, repo)))
+}
+
+// path returns where the rewritten archive of a is cached, which depends on
+// everything the archive is made from
+func (c *archiveCache) path(a Asset) string {
+	var key = fmt.Sprintf("%s@%s:%s:%s:%t", repoOf(a.Owner, a.Repo), a.Ref, a.Subdir, a.Name, a.Sdist)
+	var sum = sha256.Sum256([]byte(key))
+	return filepath.Join(c.repoDir(a.Owner, a.Repo), hex.EncodeToString(sum[:])+".tar.gz")
+}
+
+// sum returns the size and hex encoded sha256 hash of the cached archive of a
+func (c *archiveCache) sum(a Asset) (archiveSum, bool) {
+	var p = c.path(a)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.sums[p]; ok {
+		return s, true
+	}
+
+	var f, err = os.Open(p)
+	if err != nil {
+		return archiveSum{}, false
+	}
+	defer f.Close()
+	var h = sha256.New()
+	var n int64
+	if n, err = io.Copy(h, f); err != nil {
+		return archiveSum{}, false
+	}
+	var s = archiveSum{size: int(n), sha256: hex.EncodeToString(h.Sum(nil))}
+	c.sums[p] = s
+	return s, true
+}
+
+// open returns a response with the cached archive of a, if there is one
+func (c *archiveCache) open(a Asset) (*http.Response, bool) {
+	var f, err = os.Open(c.path(a))
+	if err != nil {
+		return nil, false
+	}
+	var info os.FileInfo
+	if info, err = f.Stat(); err != nil {
+		f.Close()
+		return nil, false
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": []string{strconv.FormatInt(info.Size(), 10)}},
+		ContentLength: info.Size(),
+		Body:          f,
+	}, true
+}
+
+// prune removes the cached archives of owner/repo which aren't one of assets
+func (c *archiveCache) prune(owner string, repo string, assets []Asset) {
+	var keep = make(map[string]bool)
+	for _, a := range assets {
+		if a.rewritten() {
+			keep[c.path(a)] = true
+		}
+	}
+	var paths, err = filepath.Glob(filepath.Join(c.repoDir(owner, repo), "*.tar.gz"))
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range paths {
+		if keep[p] {
+			continue
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			slog.Warn("error removing cached archive", "path", p, "error", err)
+			continue
+		}
+		delete(c.sums, p)
+	}
+}
+
+// store writes the archive of a to w using write, and caches it once it is
+// complete. Nothing is cached when writing to w fails, e.g. because the
+// reader went away before the end of the archive.
+func (c *archiveCache) store(a Asset, w io.Writer, write func(w io.Writer) error) error {
+	var tmp *os.File
+	var err = os.MkdirAll(c.dir, 0755)
+	if err == nil {
+		tmp, err = ioutil.TempFile(c.dir, ".tmp-")
+	}
+	if err != nil {
+		slog.Warn("error caching archive", "asset", a.URL(), "error", err)
+		return write(w)
+	}
+
+	var h = sha256.New()
+	err = write(io.MultiWriter(w, tmp, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The archive is complete by now, failing to cache it is no reason to fail the download
+	var info os.FileInfo
+	var p = c.path(a)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info, err = os.Stat(tmp.Name()); err == nil {
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Warn("error caching archive", "asset", a.URL(), "error", err)
+		return nil
+	}
+	c.sums[p] = archiveSum{size: int(info.Size()), sha256: hex.EncodeToString(h.Sum(nil))}
+	return nil
+}
+
+// rewrittenBody is the body of a rewritten archive. The archive is cached by
+// the time its end has been read, closing the body before then stops the
+// download without caching it.
+type rewrittenBody struct {
+	*io.PipeReader
+	upstream io.Closer
+	done     chan struct{}
+}
+
+func (b *rewrittenBody) Close() error {
+	var err = b.PipeReader.Close()
+	// Unblock a rewrite waiting on GitHub, then wait for it to clean up
+	b.upstream.Close()
+	<-b.done
+	return err
+}
+
+// fetchRewritten returns the rewritten tag archive of a from the cache, or
+// fetches it from GitHub and rewrites it on the fly (see rewriteArchive)
+func (c *Client) fetchRewritten(ctx context.Context, a Asset) (*http.Response, error) {
+	if resp, ok := c.archives.open(a); ok {
+		return resp, nil
+	}
+
+	var u, accept = c.assetPath(a)
+	// Ranges and conditional requests don't apply to the rewritten archive
+	var resp, err = c.fetch(ctx, "GET", u, accept, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	var pr, pw = io.Pipe()
+	var body = resp.Body
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		var err = c.archives.store(a, pw, func(w io.Writer) error {
+			return rewriteArchive(w, body, a)
+		})
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = &rewrittenBody{PipeReader: pr, upstream: body, done: done}
+	resp.ContentLength = -1
+	for _, k := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		resp.Header.Del(k)
+	}
+	return resp, nil
+}
+
+// headRewritten returns the headers of the rewritten tag archive of a, its
+// length is only known once it has been cached
+func (c *Client) headRewritten(a Asset) *http.Response {
+	if resp, ok := c.archives.open(a); ok {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		return resp
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		ContentLength: -1,
+		Body:          http.NoBody,
+	}
+}
+
+// pruneArchives removes the cached archives of the repo r which aren't one of assets
+func (c *Client) pruneArchives(r string, assets []Asset) {
+	var owner, repo = c.splitRepoName(r)
+	c.archives.prune(owner, repo, assets)
+}
+
+// setArchiveSums sets the size and sha256 hash of the rewritten tag archives
+// in assets which have been cached
+func (c *Client) setArchiveSums(assets []Asset) {
+	for i := range assets {
+		if !assets[i].rewritten() {
+			continue
+		}
+		if s, ok := c.archives.sum(assets[i]); ok {
+			assets[i].Size = s.size
+			assets[i].SHA256 = s.sha256
+		}
+	}
+}
@@ -1,31 +1,120 @@
 package pypihub
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brettlangdon/pypihub/pep440"
 )
 
 type Asset struct {
-	ID     int
-	Name   string
-	Owner  string
-	Repo   string
-	Ref    string
-	Format string
+	ID      int
+	Name    string
+	Owner   string
+	Repo    string
+	Version string
+	Ref     string
+	Format  string
+
+	// Project and Subdir are only set for the packages of monorepos (see
+	// --package), Subdir only for tag archives which are rewritten to
+	// contain just the package
+	Project string
+	Subdir  string
+	// Sdist is set for tag archives repackaged into sdists (see --sdists)
+	Sdist bool
+
+	// Size, Uploaded and SHA256 are only known for release assets, SHA256
+	// only when GitHub has computed a digest for the asset. Size and SHA256
+	// are also known for rewritten tag archives once they are cached.
+	Size     int
+	Uploaded time.Time
+	SHA256   string
+
+	// Yanked is copied from the release the asset belongs to
+	Yanked       bool
+	YankedReason string
+
+	// Metadata is read from wheels and sdists during syncs, nil when it
+	// couldn't be found or --no-metadata is given
+	Metadata *Metadata
 }
 
 func (a Asset) String() string {
 	return a.Name
 }
 
+// rewritten reports whether the asset is a tag archive pypihub rewrites
+func (a Asset) rewritten() bool {
+	return a.Format == "tarball" && (a.Subdir != "" || a.Sdist)
+}
+
 func (a Asset) URL() string {
 	return fmt.Sprintf("/%s/%s/%s", a.Owner, a.Repo, a.Name)
 }
 
-func (a Asset) Download(c *Client) (io.ReadCloser, error) {
-	if a.Ref != "" && a.Format != "" {
-		return c.DownloadArchive(a)
+// Download returns the full contents of the asset, the download is cancelled when ctx is done
+func (a Asset) Download(ctx context.Context, c *Client) (io.ReadCloser, error) {
+	var resp *http.Response
+	var err error
+	resp, err = c.Fetch(ctx, a, nil)
+	if err != nil {
+		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading %s: unexpected status %s", a.Name, resp.Status)
+	}
+	return resp.Body, nil
+}
 
-	return c.DownloadAsset(a)
+// sortAssets orders the assets of a repo by version, oldest first, then by name
+func sortAssets(assets []Asset) {
+	sort.SliceStable(assets, func(i, j int) bool {
+		if c := pep440.Compare(assets[i].Version, assets[j].Version); c != 0 {
+			return c < 0
+		}
+		return assets[i].Name < assets[j].Name
+	})
+}
+
+// Release is a GitHub release of a repo, or a tag of a repo without releases
+type Release struct {
+	Owner string
+	Repo  string
+	// Project is only set for the packages of monorepos
+	Project   string
+	Version   string
+	Tag       string
+	Published time.Time
+
+	// NotesHTML is the body of the release as rendered by GitHub
+	NotesHTML string
+
+	// Yanked releases (PEP 592) are only installed when pinned to exactly,
+	// see parseYanked
+	Yanked       bool
+	YankedReason string
+}
+
+// parseYanked reports whether release notes mark their release as yanked, by
+// starting with a 'Yanked' or 'Yanked: <reason>' line
+func parseYanked(notes string) (bool, string) {
+	var line = strings.TrimSpace(strings.SplitN(strings.TrimSpace(notes), "\n", 2)[0])
+	if len(line) < 6 || !strings.EqualFold(line[:6], "yanked") {
+		return false, ""
+	}
+	var rest = strings.TrimSpace(line[6:])
+	if rest == "" {
+		return true, ""
+	}
+	if rest[0] != ':' {
+		return false, ""
+	}
+	return true, strings.TrimSpace(rest[1:])
 }
@@ -0,0 +1,330 @@
+package pypihub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent records a single package download
+type AuditEvent struct {
+	Time     time.Time `json:"timestamp"`
+	ClientIP string    `json:"client_ip"`
+	Identity string    `json:"identity,omitempty"`
+	Auth     string    `json:"auth_method,omitempty"`
+	Project  string    `json:"project"`
+	Version  string    `json:"version"`
+	Filename string    `json:"filename"`
+	Bytes    int64     `json:"bytes_sent"`
+	Cache    string    `json:"cache,omitempty"`
+	Status   int       `json:"status"`
+}
+
+// rotatingFile is an append only log file which is rotated, by renaming it
+// with a timestamp and sequence number suffix, once it grows over maxSize bytes or gets older than
+// maxAge. Only the newest maxFiles rotated files are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingFile, error) {
+	var r = &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	var f, err = os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	// We can't know when an existing file was created, so count its age from now
+	r.created = time.Now()
+	return nil
+}
+
+// rotatedLayout is the timestamp in the names of rotated files, which are
+// '<path>.<timestamp>-<seq>' with seq counting the rotations within the same
+// millisecond
+const rotatedLayout = "20060102T150405.000"
+
+type rotatedFile struct {
+	name string
+	time time.Time
+	seq  int
+}
+
+// parseRotated parses the suffix of a rotated file name, anything else that
+// shares the path as a prefix isn't ours
+func (r *rotatingFile) parseRotated(name string) (rotatedFile, bool) {
+	var prefix = filepath.Base(r.path) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return rotatedFile{}, false
+	}
+	var suffix = name[len(prefix):]
+	var i = strings.LastIndex(suffix, "-")
+	if i < 0 {
+		return rotatedFile{}, false
+	}
+	var t, err = time.Parse(rotatedLayout, suffix[:i])
+	if err != nil {
+		return rotatedFile{}, false
+	}
+	var seq int
+	seq, err = strconv.Atoi(suffix[i+1:])
+	if err != nil || seq < 1 || strconv.Itoa(seq) != suffix[i+1:] {
+		return rotatedFile{}, false
+	}
+	return rotatedFile{name: name, time: t, seq: seq}, true
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	var now = time.Now().UTC().Format(rotatedLayout)
+	var rotated string
+	for seq := 1; ; seq++ {
+		rotated = fmt.Sprintf("%s.%s-%d", r.path, now, seq)
+		if _, err := os.Lstat(rotated); err != nil {
+			break
+		}
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune removes all but the newest maxFiles rotated files
+func (r *rotatingFile) prune() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	var dir = filepath.Dir(r.path)
+	var entries, err = ioutil.ReadDir(dir)
+	if err != nil {
+		slog.Warn("error listing rotated audit logs", "path", dir, "error", err)
+		return
+	}
+	var rotated []rotatedFile
+	for _, entry := range entries {
+		if f, ok := r.parseRotated(entry.Name()); ok && entry.Mode().IsRegular() {
+			rotated = append(rotated, f)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		if !rotated[i].time.Equal(rotated[j].time) {
+			return rotated[i].time.Before(rotated[j].time)
+		}
+		return rotated[i].seq < rotated[j].seq
+	})
+	for len(rotated) > r.maxFiles {
+		var path = filepath.Join(dir, rotated[0].name)
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("error removing rotated audit log", "path", path, "error", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	var tooBig = r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	var tooOld = r.maxAge > 0 && time.Since(r.created) > r.maxAge
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n, err = r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+type auditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newAuditLogger(config Config) (*auditLogger, error) {
+	if config.AuditLog == "-" {
+		return &auditLogger{w: os.Stdout}, nil
+	}
+
+	var f, err = openRotatingFile(config.AuditLog, config.AuditLogMaxSize*1024*1024, config.AuditLogMaxAge, config.AuditLogMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{w: f}, nil
+}
+
+func (a *auditLogger) Log(event AuditEvent) {
+	var data, err = json.Marshal(event)
+	if err != nil {
+		slog.Error("error encoding audit event", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		slog.Error("error writing audit event", "error", err)
+	}
+}
+
+// parseCIDRs parses a list of IP addresses or CIDR ranges
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		var _, n, err = net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (r *Router) trustedProxy(ip net.IP) bool {
+	for _, n := range r.config.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making req, following
+// X-Forwarded-For and X-Real-IP headers only when set by trusted proxies
+func (r *Router) clientIP(req *http.Request) string {
+	var host, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	var ip = net.ParseIP(host)
+	if ip == nil || !r.trustedProxy(ip) {
+		return host
+	}
+
+	// Walk the chain from the nearest hop, the client is the first
+	// address which isn't one of our trusted proxies
+	var hops = strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		var hop = net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !r.trustedProxy(hop) {
+			return hop.String()
+		}
+	}
+
+	if real := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); real != nil {
+		return real.String()
+	}
+	return ip.String()
+}
+
+// countingWriter records the status and number of body bytes of a response
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	var n, err = c.ResponseWriter.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Status() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+	return c.status
+}
+
+// audit records the download of a, if audit logging is enabled
+func (r *Router) audit(req *http.Request, a Asset, w *countingWriter, cache string) {
+	if r.auditLog == nil {
+		return
+	}
+
+	var event = AuditEvent{
+		Time:     time.Now().UTC(),
+		ClientIP: r.clientIP(req),
+		Project:  projectName(a),
+		Version:  a.Version,
+		Filename: a.Name,
+		Bytes:    w.bytes,
+		Cache:    cache,
+		Status:   w.Status(),
+	}
+	if id := RequestIdentity(req); id != nil {
+		event.Identity = id.Name
+		event.Auth = id.Method
+	}
+	r.auditLog.Log(event)
+}
@@ -0,0 +1,187 @@
+package pypihub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Grant is a pattern of assets an identity may read. Patterns are globs
+// matched against '<owner>/<repo>' (e.g. 'acme/*'), or against the project
+// name, normalized as per PEP 503, when prefixed with 'project:' (e.g. 'project:acme-*')
+type Grant string
+
+func (g Grant) Matches(a Asset) bool {
+	var pattern = strings.ToLower(string(g))
+	if strings.HasPrefix(pattern, "project:") {
+		var ok, _ = path.Match(normalizeProjectName(strings.TrimPrefix(pattern, "project:")), projectName(a))
+		return ok
+	}
+	var ok, _ = path.Match(pattern, strings.ToLower(a.Owner+"/"+a.Repo))
+	return ok
+}
+
+// Identity is who made a request
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+
+	// Grants limits which assets the identity may read, nil means everything
+	Grants []Grant `json:"grants,omitempty"`
+}
+
+// CanRead reports whether the identity may see the asset a
+func (id *Identity) CanRead(a Asset) bool {
+	if id == nil || id.Grants == nil {
+		return true
+	}
+	for _, g := range id.Grants {
+		if g.Matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantCondition is a single '<claim> == <value>' check of a grantRule
+type grantCondition struct {
+	claim string
+	value string
+}
+
+// grantRule grants read access to assets when all of its conditions match
+// the claims of a credential, e.g. an OIDC token or a client certificate
+type grantRule struct {
+	conditions []grantCondition
+	grants     []Grant
+}
+
+// parseGrantRule parses a rule like
+// 'repository_owner == acme && ref_type == tag => acme/* project:shared-*'
+func parseGrantRule(s string) (grantRule, error) {
+	var rule grantRule
+	var p = strings.SplitN(s, "=>", 2)
+	if len(p) != 2 {
+		return rule, fmt.Errorf("invalid rule %q, expected '<claim> == <value> [&& ...] => <grant> [<grant> ...]'", s)
+	}
+
+	for _, cond := range strings.Split(p[0], "&&") {
+		var c = strings.SplitN(cond, "==", 2)
+		if len(c) != 2 || strings.TrimSpace(c[0]) == "" {
+			return rule, fmt.Errorf("invalid rule %q, condition %q is not '<claim> == <value>'", s, strings.TrimSpace(cond))
+		}
+		rule.conditions = append(rule.conditions, grantCondition{
+			claim: strings.TrimSpace(c[0]),
+			value: strings.Trim(strings.TrimSpace(c[1]), "\"'"),
+		})
+	}
+
+	for _, g := range strings.Fields(p[1]) {
+		rule.grants = append(rule.grants, Grant(g))
+	}
+	if len(rule.grants) == 0 {
+		return rule, fmt.Errorf("invalid rule %q, no grants given", s)
+	}
+	return rule, validateGrants(rule.grants)
+}
+
+func (r grantRule) matches(claims map[string]interface{}) bool {
+	for _, c := range r.conditions {
+		var v, ok = claims[c.claim]
+		if !ok || fmt.Sprint(v) != c.value {
+			return false
+		}
+	}
+	return true
+}
+
+// grantsFor returns the grants of every rule matching claims
+func grantsFor(rules []grantRule, claims map[string]interface{}) []Grant {
+	var grants = make([]Grant, 0)
+	for _, rule := range rules {
+		if rule.matches(claims) {
+			grants = append(grants, rule.grants...)
+		}
+	}
+	return grants
+}
+
+// authenticator checks the credentials of a request
+type authenticator interface {
+	// Authenticate returns who the request's credentials belong to, or nil
+	// if it does not recognize them
+	Authenticate(req *http.Request) *Identity
+}
+
+type identityKey struct{}
+
+func withIdentity(req *http.Request, id *Identity) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, id))
+}
+
+// RequestIdentity returns who made the request, or nil for anonymous requests
+func RequestIdentity(req *http.Request) *Identity {
+	var id, _ = req.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// visibleAssets returns the assets the client making req is allowed to see,
+// everything else should look like it doesn't exist
+func (r *Router) visibleAssets(req *http.Request) []Asset {
+	var _, span = startSpan(req.Context(), "snapshot lookup", trace.SpanKindInternal)
+	defer span.End()
+
+	var id = RequestIdentity(req)
+	var assets = r.syncer.Assets()
+	if id != nil && id.Grants != nil {
+		assets = filterAssets(assets, id.CanRead)
+	}
+	span.SetAttributes(attribute.Int("assets", len(assets)))
+	return assets
+}
+
+func (r *Router) authExempt(req *http.Request) bool {
+	// Admin endpoints are protected by the admin token instead
+	if strings.HasPrefix(req.URL.Path, "/admin/") {
+		return true
+	}
+	for _, p := range r.config.AuthExempt {
+		if req.URL.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Basic realm=\"pypihub\"")
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// authenticate requires every request, apart from exempt ones, to carry
+// credentials one of the configured authenticators accepts
+func (r *Router) authenticate(h http.Handler) http.Handler {
+	if len(r.authenticators) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.authExempt(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		for _, a := range r.authenticators {
+			if id := a.Authenticate(req); id != nil {
+				h.ServeHTTP(w, withIdentity(req, id))
+				return
+			}
+		}
+		unauthorized(w)
+	})
+}
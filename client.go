@@ -1,129 +1,357 @@
 package pypihub
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/github"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
 	config Config
 	client *github.Client
 	repos  []string
+
+	// api is used for GitHub API requests whose redirects we need to see
+	// rather than follow, e.g. to find where a download lives
+	api *http.Client
+	// downloads is used to fetch assets from where GitHub redirects to
+	downloads *http.Client
+
+	upstream *upstreamMetrics
+	archives *archiveCache
 }
 
 func NewClient(cfg Config) *Client {
-	var t = github.BasicAuthTransport{
-		Username: cfg.Username,
-		Password: cfg.AccessToken,
+	var upstream = newUpstreamMetrics()
+	var t = &instrumentedTransport{
+		next: &basicAuthTransport{
+			Username: cfg.Username,
+			Password: cfg.accessToken,
+			next:     &propagatingTransport{next: http.DefaultTransport},
+		},
+		metrics: upstream,
 	}
 	return &Client{
 		config: cfg,
-		client: github.NewClient(t.Client()),
+		client: github.NewClient(&http.Client{Transport: t}),
 		repos:  cfg.RepoNames,
+		api: &http.Client{
+			Transport: t,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		downloads: &http.Client{
+			Transport: &propagatingTransport{next: http.DefaultTransport},
+		},
+		upstream: upstream,
+		archives: newArchiveCache(cfg.ArchiveCache),
+	}
+}
+
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// RateLimit returns the GitHub core rate limit as of the most recent API call
+func (c *Client) RateLimit() RateLimit {
+	var rate = c.client.Rate()
+	return RateLimit{
+		Limit:     rate.Limit,
+		Remaining: rate.Remaining,
+		Reset:     rate.Reset.Time,
 	}
 }
 
 func (c *Client) splitRepoName(r string) (string, string) {
-	var p = strings.SplitN(r, "/", 2)
-	switch len(p) {
-	case 2:
-		return p[0], p[1]
-	case 1:
-		return c.config.Username, p[0]
-	default:
-		return "", ""
+	return c.config.splitRepoName(r)
+}
+
+// getJSON makes a GET request for the GitHub API path u, decoding the response
+// into v, or copying it into v as is when v is an io.Writer
+func (c *Client) getJSON(ctx context.Context, u string, accept string, v interface{}) error {
+	var req, err = c.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	_, err = c.client.Do(req.WithContext(ctx), v)
+	return err
+}
+
+// githubRelease adds the fields go-github doesn't know about to a release
+type githubRelease struct {
+	github.RepositoryRelease
+	BodyHTML *string `json:"body_html,omitempty"`
+}
+
+// githubAsset adds the fields go-github doesn't know about to a release asset
+type githubAsset struct {
+	github.ReleaseAsset
+	Digest *string `json:"digest,omitempty"`
+}
+
+// releaseTarget is the project and version a tag or release is for
+type releaseTarget struct {
+	// project and subdir are only set for the packages of monorepos
+	project string
+	subdir  string
+	version string
+}
+
+// name returns the project name used in the file names of the release
+func (t releaseTarget) name(repo string) string {
+	if t.project != "" {
+		return t.project
 	}
+	return repo
 }
 
-func (c *Client) getRepoTagAssets(owner string, repo string) ([]Asset, error) {
+// archiveName returns the file name of the tag archive of the target t
+func (c *Client) archiveName(repo string, t releaseTarget) string {
+	if c.config.Sdists {
+		return sdistName(t.name(repo), t.version) + ".tar.gz"
+	}
+	return fmt.Sprintf("%s-%s.tar.gz", t.name(repo), t.version)
+}
+
+// releaseTarget returns the target of a tag or release of owner/repo, using
+// the packages defined for the repo or its version rule, logging why it is
+// skipped otherwise. name is the release name, if any.
+func (c *Client) releaseTarget(owner string, repo string, tag string, name string) (releaseTarget, bool) {
+	var r = owner + "/" + repo
+	var err = errNoVersion
+	var t releaseTarget
+	if packages := c.config.repoPackages(r); len(packages) > 0 {
+		for _, pkg := range packages {
+			t = releaseTarget{project: pkg.project, subdir: pkg.subdir}
+			if t.version, err = pkg.rule.version(tag); err != errNoVersion {
+				break
+			}
+		}
+	} else {
+		var rule = c.config.versionRule(r)
+		// Tags without a release, and releases left untitled, only have their tag
+		if rule.from == VersionFromName && name != "" {
+			tag = name
+		}
+		t.version, err = rule.version(tag)
+	}
+
+	switch {
+	case err == errNoVersion:
+		slog.Debug("ignoring release not matching the tag pattern", "repo", r, "name", tag)
+		return t, false
+	case err != nil:
+		slog.Warn("skipping release without a PEP 440 version", "repo", r, "name", tag)
+		return t, false
+	}
+	return t, true
+}
+
+func (c *Client) getRepoTagAssets(ctx context.Context, owner string, repo string) ([]Release, []Asset, error) {
 	var tags []*github.RepositoryTag
-	var err error
-	tags, _, err = c.client.Repositories.ListTags(owner, repo, nil)
+	var err = c.getJSON(ctx, fmt.Sprintf("repos/%s/%s/tags", owner, repo), "", &tags)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var releases = make([]Release, 0)
 	var allAssets = make([]Asset, 0)
 	for _, tag := range tags {
-		// Remove any `v` prefix, e.g. `v1.0.0` -> `1.0.0`
-		var name = strings.Trim(*tag.Name, "v")
-		name = fmt.Sprintf("%s-%s.tar.gz", repo, name)
+		if tag == nil || tag.Name == nil {
+			continue
+		}
+		var t, ok = c.releaseTarget(owner, repo, *tag.Name, "")
+		if !ok {
+			continue
+		}
+		releases = append(releases, Release{
+			Owner:   owner,
+			Repo:    repo,
+			Project: t.project,
+			Version: t.version,
+			Tag:     *tag.Name,
+		})
 		allAssets = append(allAssets, Asset{
-			Name:   name,
-			Owner:  owner,
-			Repo:   repo,
-			Ref:    *tag.Name,
-			Format: "tarball",
+			Name:    c.archiveName(repo, t),
+			Owner:   owner,
+			Repo:    repo,
+			Project: t.project,
+			Version: t.version,
+			Ref:     *tag.Name,
+			Format:  "tarball",
+			Subdir:  t.subdir,
+			Sdist:   c.config.Sdists,
 		})
 	}
 
-	return allAssets, nil
+	sortAssets(allAssets)
+	return releases, allAssets, nil
 }
 
-func (c *Client) GetRepoAssets(r string) ([]Asset, error) {
-	var owner, repo string
-	owner, repo = c.splitRepoName(r)
-
-	var releases []*github.RepositoryRelease
-	var err error
-	releases, _, err = c.client.Repositories.ListReleases(owner, repo, nil)
+func (c *Client) getRepoReleases(ctx context.Context, owner string, repo string) ([]Release, []Asset, error) {
+	var rels []*githubRelease
+	var err = c.getJSON(ctx, fmt.Sprintf("repos/%s/%s/releases", owner, repo), "application/vnd.github.v3.full+json", &rels)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if len(releases) == 0 {
-		return c.getRepoTagAssets(owner, repo)
+	if len(rels) == 0 {
+		return c.getRepoTagAssets(ctx, owner, repo)
 	}
 
+	var releases = make([]Release, 0, len(rels))
 	var allAssets = make([]Asset, 0)
-	for _, rel := range releases {
-		var assets []*github.ReleaseAsset
-		assets, _, err = c.client.Repositories.ListReleaseAssets(owner, repo, *rel.ID, nil)
+	for _, rel := range rels {
+		if rel == nil || rel.ID == nil || rel.TagName == nil {
+			continue
+		}
+		var t, ok = c.releaseTarget(owner, repo, *rel.TagName, stringValue(rel.Name))
+		if !ok {
+			continue
+		}
+		var version = t.version
+
+		var assets []*githubAsset
+		err = c.getJSON(ctx, fmt.Sprintf("repos/%s/%s/releases/%d/assets", owner, repo, *rel.ID), "", &assets)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		var release = Release{
+			Owner:   owner,
+			Repo:    repo,
+			Project: t.project,
+			Version: version,
+			Tag:     *rel.TagName,
+		}
+		if rel.PublishedAt != nil {
+			release.Published = rel.PublishedAt.Time
+		}
+		if rel.BodyHTML != nil {
+			release.NotesHTML = *rel.BodyHTML
 		}
+		if rel.Body != nil {
+			release.Yanked, release.YankedReason = parseYanked(*rel.Body)
+		}
+		releases = append(releases, release)
 
 		var hasTar = false
 		for _, a := range assets {
+			if a == nil || a.ID == nil || a.Name == nil {
+				continue
+			}
 			if strings.HasSuffix(*a.Name, ".tar.gz") {
 				hasTar = true
 			}
-			allAssets = append(allAssets, Asset{
-				ID:    *a.ID,
-				Name:  *a.Name,
-				Owner: owner,
-				Repo:  repo,
-			})
+			var asset = Asset{
+				ID:           *a.ID,
+				Name:         *a.Name,
+				Owner:        owner,
+				Repo:         repo,
+				Project:      t.project,
+				Version:      version,
+				Yanked:       release.Yanked,
+				YankedReason: release.YankedReason,
+			}
+			if a.Size != nil {
+				asset.Size = *a.Size
+			}
+			if a.UpdatedAt != nil {
+				asset.Uploaded = a.UpdatedAt.Time
+			}
+			if a.Digest != nil && strings.HasPrefix(*a.Digest, "sha256:") {
+				asset.SHA256 = strings.TrimPrefix(*a.Digest, "sha256:")
+			}
+			allAssets = append(allAssets, asset)
 		}
 
 		if hasTar == false {
-			// Remove any `v` prefix, e.g. `v1.0.0` -> `1.0.0`
-			var name = strings.Trim(*rel.Name, "v")
-			name = fmt.Sprintf("%s-%s.tar.gz", repo, name)
 			allAssets = append(allAssets, Asset{
-				Name:   name,
-				Owner:  owner,
-				Repo:   repo,
-				Ref:    *rel.TagName,
-				Format: "tarball",
+				Name:         c.archiveName(repo, t),
+				Owner:        owner,
+				Repo:         repo,
+				Project:      t.project,
+				Version:      version,
+				Ref:          *rel.TagName,
+				Format:       "tarball",
+				Subdir:       t.subdir,
+				Sdist:        c.config.Sdists,
+				Yanked:       release.Yanked,
+				YankedReason: release.YankedReason,
 			})
 		}
 
 	}
-	return allAssets, nil
+	sortAssets(allAssets)
+	return releases, allAssets, nil
+}
+
+// getReadme returns the README of a repo as rendered by GitHub, or "" when it has none
+func (c *Client) getReadme(ctx context.Context, owner string, repo string) (string, error) {
+	var buf bytes.Buffer
+	var err = c.getJSON(ctx, fmt.Sprintf("repos/%s/%s/readme", owner, repo), "application/vnd.github.v3.html", &buf)
+	if githubStatus(err) == http.StatusNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (c *Client) GetRepoAssets(ctx context.Context, r string) ([]Asset, error) {
+	var owner, repo string
+	owner, repo = c.splitRepoName(r)
+
+	var _, assets, err = c.getRepoReleases(ctx, owner, repo)
+	return assets, err
+}
+
+// RepoSnapshot is everything synced from a single repo
+type RepoSnapshot struct {
+	Assets   []Asset
+	Releases []Release
+	Readme   string
+}
+
+// GetRepo fetches the releases, assets and README of the repo r
+func (c *Client) GetRepo(ctx context.Context, r string) (RepoSnapshot, error) {
+	var owner, repo = c.splitRepoName(r)
+
+	var snapshot RepoSnapshot
+	var err error
+	snapshot.Releases, snapshot.Assets, err = c.getRepoReleases(ctx, owner, repo)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Readme, err = c.getReadme(ctx, owner, repo)
+	return snapshot, err
 }
 
-func (c *Client) GetAllAssets() ([]Asset, error) {
+func (c *Client) GetAllAssets(ctx context.Context) ([]Asset, error) {
 	var allAssets = make([]Asset, 0)
 	for _, r := range c.config.RepoNames {
 		var repoAssets = make([]Asset, 0)
 		var err error
-		repoAssets, err = c.GetRepoAssets(r)
+		repoAssets, err = c.GetRepoAssets(ctx, r)
 		if err != nil {
 			return nil, err
 		}
@@ -133,39 +361,263 @@ func (c *Client) GetAllAssets() ([]Asset, error) {
 	return allAssets, nil
 }
 
-func (c *Client) DownloadAsset(a Asset) (io.ReadCloser, error) {
-	var rc io.ReadCloser
-	var redirect string
+// locate asks the GitHub API for the contents at the API path u, returning
+// either the URL they redirected us to, or the response carrying them directly.
+// header is sent along in case GitHub serves the contents directly.
+func (c *Client) locate(ctx context.Context, method string, u string, accept string, header http.Header) (string, *http.Response, error) {
+	var req *http.Request
 	var err error
-	rc, redirect, err = c.client.Repositories.DownloadReleaseAsset(a.Owner, a.Repo, a.ID)
-	if rc == nil {
-		var resp *http.Response
-		resp, err = http.Get(redirect)
-		if err != nil {
-			return nil, err
+	req, err = c.client.NewRequest(method, u, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	var resp *http.Response
+	resp, err = c.api.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+		resp.Body.Close()
+		var loc = resp.Header.Get("Location")
+		if loc == "" {
+			return "", nil, fmt.Errorf("%s %s: redirect without a location", req.Method, req.URL)
 		}
-		rc = resp.Body
+		return loc, nil, nil
+	case http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+		// Answers to the conditional and range requests in header
+		return "", resp, nil
 	}
-	return rc, err
-}
 
-func (c *Client) DownloadArchive(a Asset) (io.ReadCloser, error) {
-	var f = github.Tarball
-	if a.Format == "zipball" {
-		f = github.Zipball
+	if err = github.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return "", nil, err
 	}
+	return "", resp, nil
+}
 
-	var u *url.URL
+func (c *Client) get(ctx context.Context, method string, u string, header http.Header) (*http.Response, error) {
+	var req *http.Request
 	var err error
-	u, _, err = c.client.Repositories.GetArchiveLink(a.Owner, a.Repo, f, nil)
+	req, err = http.NewRequest(method, u, nil)
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	var span trace.Span
+	ctx, span = startSpan(ctx, method+" download", trace.SpanKindClient,
+		semconv.HTTPRequestMethodKey.String(method),
+		semconv.ServerAddress(req.URL.Host),
+	)
+	var resp *http.Response
+	resp, err = c.downloads.Do(req.WithContext(ctx))
+	if err != nil {
+		recordError(span, err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	// The download isn't over until the body has been read
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
 
+func (c *Client) fetch(ctx context.Context, method string, u string, accept string, header http.Header) (*http.Response, error) {
+	var loc string
 	var resp *http.Response
-	resp, err = http.Get(u.String())
+	var err error
+	loc, resp, err = c.locate(ctx, method, u, accept, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		return resp, nil
+	}
+	return c.get(ctx, method, loc, header)
+}
+
+func (c *Client) assetPath(a Asset) (string, string) {
+	if a.Ref != "" && a.Format != "" {
+		var f = github.Tarball
+		if a.Format == "zipball" {
+			f = github.Zipball
+		}
+		return fmt.Sprintf("repos/%s/%s/%s/%s", a.Owner, a.Repo, f, url.PathEscape(a.Ref)), ""
+	}
+	return fmt.Sprintf("repos/%s/%s/releases/assets/%d", a.Owner, a.Repo, a.ID), "application/octet-stream"
+}
+
+// Locate returns the short lived URL the contents of a release asset or tag
+// archive can be downloaded from directly
+func (c *Client) Locate(ctx context.Context, a Asset) (string, error) {
+	var u, accept = c.assetPath(a)
+	var loc, resp, err = c.locate(ctx, "GET", u, accept, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp != nil {
+		resp.Body.Close()
+		return "", fmt.Errorf("GitHub served %s directly instead of redirecting", a.Name)
+	}
+	return loc, nil
+}
+
+// Fetch requests the contents of a release asset or tag archive, sending
+// header along with the request for the contents, e.g. to ask for a byte range.
+// The request is cancelled when ctx is done, and it is the caller's
+// responsibility to check the response status and close the body.
+func (c *Client) Fetch(ctx context.Context, a Asset, header http.Header) (*http.Response, error) {
+	if a.rewritten() {
+		return c.fetchRewritten(ctx, a)
+	}
+	var u, accept = c.assetPath(a)
+	return c.fetch(ctx, "GET", u, accept, header)
+}
+
+// Head is like Fetch but only returns the headers of the contents. GitHub
+// redirects downloads to URLs signed for GET only, so the headers come from
+// a GET of the first byte, answered as if the whole contents were asked for.
+func (c *Client) Head(ctx context.Context, a Asset, header http.Header) (*http.Response, error) {
+	if a.rewritten() {
+		return c.headRewritten(a), nil
+	}
+
+	var h = make(http.Header)
+	for k, v := range header {
+		h[k] = v
+	}
+	h.Del("If-Range")
+	h.Set("Range", "bytes=0-0")
+	var u, accept = c.assetPath(a)
+	var resp, err = c.fetch(ctx, "GET", u, accept, h)
 	if err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
+	resp.Body.Close()
+	resp.Body = http.NoBody
+
+	// 'bytes 0-0/<size>', or 'bytes */0' when the contents are empty
+	var cr = resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(cr, "/"); i >= 0 && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
+		var size, err = strconv.ParseInt(cr[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("GitHub sent an invalid Content-Range %q", cr)
+		}
+		resp.Status = "200 OK"
+		resp.StatusCode = http.StatusOK
+		resp.ContentLength = size
+		resp.Header.Del("Content-Range")
+		resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	return resp, nil
+}
+
+// rangeReaderChunk is the least rangeReader fetches at once, so that e.g. the
+// directory at the end of a zip is usually read in a single request
+const rangeReaderChunk = 64 << 10
+
+// rangeReader reads parts of an asset with HTTP range requests, so archives
+// like wheels can be inspected without downloading them in full
+type rangeReader struct {
+	ctx  context.Context
+	c    *Client
+	a    Asset
+	loc  string
+	size int64
+
+	// buf holds the most recently fetched range, starting at off
+	buf []byte
+	off int64
+}
+
+func newRangeReader(ctx context.Context, c *Client, a Asset) (*rangeReader, error) {
+	var loc, err = c.Locate(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	var r = &rangeReader{ctx: ctx, c: c, a: a, loc: loc, size: int64(a.Size)}
+	if r.size <= 0 {
+		// Learn the size from the Content-Range of a single byte
+		if _, err = r.fetch(0, 1); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Size returns the size of the asset
+func (r *rangeReader) Size() int64 {
+	return r.size
+}
+
+func (r *rangeReader) fetch(off int64, n int64) ([]byte, error) {
+	var header = make(http.Header)
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	var resp, err = r.c.get(r.ctx, "GET", r.loc, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range request for %s: unexpected status %s", r.a.Name, resp.Status)
+	}
+
+	// Content-Range: bytes <start>-<end>/<size>
+	var cr = resp.Header.Get("Content-Range")
+	if i := strings.LastIndex(cr, "/"); i >= 0 {
+		if size, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+			r.size = size
+		}
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, n))
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var end = off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	if off < r.off || end > r.off+int64(len(r.buf)) {
+		// Fetch a whole chunk around what was asked for, biased towards
+		// the end of the asset where archive directories live
+		var start, n = off, end - off
+		if n < rangeReaderChunk {
+			n = rangeReaderChunk
+			if start+n > r.size {
+				start = r.size - n
+				if start < 0 {
+					start, n = 0, r.size
+				}
+			}
+		}
+		var buf, err = r.fetch(start, n)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(buf)) < n {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.buf, r.off = buf, start
+	}
+
+	var copied = copy(p, r.buf[off-r.off:end-r.off])
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+	return copied, nil
 }
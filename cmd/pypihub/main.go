@@ -1,18 +1,53 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"github.com/brettlangdon/pypihub"
 )
 
+func fatal(err error) {
+	slog.Error(err.Error())
+	pypihub.ShutdownTracing()
+	os.Exit(1)
+}
+
+func generate() {
+	var config pypihub.Config
+	var gen pypihub.GenerateConfig
+	config, gen = pypihub.ParseGenerateConfig()
+
+	var generator *pypihub.Generator
+	var err error
+	generator, err = pypihub.NewGenerator(config, gen)
+	if err != nil {
+		fatal(err)
+	}
+	if err = generator.Run(); err != nil {
+		fatal(err)
+	}
+	pypihub.ShutdownTracing()
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		generate()
+		return
+	}
+
 	var config pypihub.Config
 	config = pypihub.ParseConfig()
 
 	var router *pypihub.Router
-	router = pypihub.NewRouter(config)
+	var err error
+	router, err = pypihub.NewRouter(config)
+	if err != nil {
+		fatal(err)
+	}
 
-	log.Printf("server listening on %s", config.Bind)
-	log.Fatal(router.Start())
+	slog.Info("server listening", "bind", config.Bind, "tls", config.TLSCert != "")
+	if err = router.Start(); err != nil {
+		fatal(err)
+	}
 }
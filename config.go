@@ -2,39 +2,467 @@ package pypihub
 
 import (
 	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	arg "github.com/alexflint/go-arg"
 )
 
 type Config struct {
 	Username    string   `arg:"-u,--username,env:PYPIHUB_USERNAME,required,help:Username of GitHub user to login as (env: PYPIHUB_USERNAME)"`
-	AccessToken string   `arg:"-a,--access-token,env:PYPIHUB_ACCESS_TOKEN,required,help:GitHub personal access token to use for authenticating (env: PYPIHUB_ACCESS_TOKEN)"`
+	AccessToken string   `arg:"-a,--access-token,env:PYPIHUB_ACCESS_TOKEN,help:GitHub personal access token to use for authenticating; prefer --access-token-file or --access-token-command (env: PYPIHUB_ACCESS_TOKEN)"`
 	RepoNames   []string `arg:"positional,help:list of '<username>/<repo>' repos to proxy for (env: PYPIHUB_REPOS)"`
 	Bind        string   `arg:"-b,--bind,env:PYPIHUB_BIND,help:[<address>]:<port> to bind the server to (default: ':8287') (env: PYPIHUB_BIND)"`
+
+	AccessTokenFile    string        `arg:"--access-token-file,env:PYPIHUB_ACCESS_TOKEN_FILE,help:file to read the GitHub access token from; it is reread when it changes (env: PYPIHUB_ACCESS_TOKEN_FILE)"`
+	AccessTokenCommand string        `arg:"--access-token-command,env:PYPIHUB_ACCESS_TOKEN_COMMAND,help:command whose output is the GitHub access token e.g. 'gh auth token' (env: PYPIHUB_ACCESS_TOKEN_COMMAND)"`
+	AdminTokenFile     string        `arg:"--admin-token-file,env:PYPIHUB_ADMIN_TOKEN_FILE,help:file to read the admin token from; it is reread when it changes (env: PYPIHUB_ADMIN_TOKEN_FILE)"`
+	AdminTokenCommand  string        `arg:"--admin-token-command,env:PYPIHUB_ADMIN_TOKEN_COMMAND,help:command whose output is the admin token (env: PYPIHUB_ADMIN_TOKEN_COMMAND)"`
+	SecretCommandTTL   time.Duration `arg:"--secret-command-ttl,env:PYPIHUB_SECRET_COMMAND_TTL,help:how long to cache the output of secret commands before rerunning them (default: 5m) (env: PYPIHUB_SECRET_COMMAND_TTL)"`
+
+	RefreshInterval      time.Duration `arg:"--refresh-interval,env:PYPIHUB_REFRESH_INTERVAL,help:how often to refetch assets from GitHub (default: 5m) (env: PYPIHUB_REFRESH_INTERVAL)"`
+	RefreshJitter        time.Duration `arg:"--refresh-jitter,env:PYPIHUB_REFRESH_JITTER,help:maximum random delay added to every refresh interval (default: 30s) (env: PYPIHUB_REFRESH_JITTER)"`
+	RepoIntervals        []string      `arg:"--repo-interval,help:list of '<owner>/<repo>=<interval>' refresh interval overrides for specific repos (env: PYPIHUB_REPO_INTERVALS)"`
+	MaxSnapshotAge       time.Duration `arg:"--max-snapshot-age,env:PYPIHUB_MAX_SNAPSHOT_AGE,help:/readyz reports not ready when a repo hasn't synced successfully for this long (default: 30m) (env: PYPIHUB_MAX_SNAPSHOT_AGE)"`
+	TLSCert              string        `arg:"--tls-cert,env:PYPIHUB_TLS_CERT,help:certificate file to serve HTTPS with; it is reloaded when it changes (env: PYPIHUB_TLS_CERT)"`
+	TLSKey               string        `arg:"--tls-key,env:PYPIHUB_TLS_KEY,help:private key file for --tls-cert (env: PYPIHUB_TLS_KEY)"`
+	TLSClientCA          string        `arg:"--tls-client-ca,env:PYPIHUB_TLS_CLIENT_CA,help:CA bundle to verify client certificates with; enables mutual TLS authentication (env: PYPIHUB_TLS_CLIENT_CA)"`
+	TLSRequireClientCert bool          `arg:"--tls-require-client-cert,env:PYPIHUB_TLS_REQUIRE_CLIENT_CERT,help:reject TLS connections without a valid client certificate (env: PYPIHUB_TLS_REQUIRE_CLIENT_CERT)"`
+	TLSClientRules       []string      `arg:"--tls-client-rule,help:list of '<claim> == <value> [&& ...] => <grant> [<grant> ...]' rules granting client certificates read access by their 'cn' 'o' 'ou' 'email' or 'subject' (env: PYPIHUB_TLS_CLIENT_RULES separated by ';')"`
+	HTTPRedirectBind     string        `arg:"--http-redirect-bind,env:PYPIHUB_HTTP_REDIRECT_BIND,help:[<address>]:<port> to serve redirects from plain HTTP to HTTPS on (env: PYPIHUB_HTTP_REDIRECT_BIND)"`
+	ReadTimeout          time.Duration `arg:"--read-timeout,env:PYPIHUB_READ_TIMEOUT,help:maximum duration for reading a request (default: 30s) (env: PYPIHUB_READ_TIMEOUT)"`
+	WriteTimeout         time.Duration `arg:"--write-timeout,env:PYPIHUB_WRITE_TIMEOUT,help:maximum duration for writing a response including downloads; 0 for no limit (default: 0) (env: PYPIHUB_WRITE_TIMEOUT)"`
+	IdleTimeout          time.Duration `arg:"--idle-timeout,env:PYPIHUB_IDLE_TIMEOUT,help:how long to keep idle keep-alive connections open (default: 2m) (env: PYPIHUB_IDLE_TIMEOUT)"`
+	ShutdownTimeout      time.Duration `arg:"--shutdown-timeout,env:PYPIHUB_SHUTDOWN_TIMEOUT,help:how long to wait for in-flight requests to finish when shutting down (default: 30s) (env: PYPIHUB_SHUTDOWN_TIMEOUT)"`
+	Delivery             string        `arg:"--delivery,env:PYPIHUB_DELIVERY,help:how to deliver downloads: 'proxy' streams them through pypihub and 'redirect' redirects clients to a short lived GitHub URL (default: 'proxy') (env: PYPIHUB_DELIVERY)"`
+	RepoVersionFrom      []string      `arg:"--repo-version-from,help:list of '<owner>/<repo>=<tag|name>' overrides of whether versions come from release tags or release names (default: 'tag') (env: PYPIHUB_REPO_VERSION_FROM)"`
+	RepoTagPrefixes      []string      `arg:"--repo-tag-prefix,help:list of '<owner>/<repo>=<prefix>' prefixes to strip from tags before reading versions from them (default: 'v') (env: PYPIHUB_REPO_TAG_PREFIXES)"`
+	RepoTagPatterns      []string      `arg:"--repo-tag-pattern,help:list of '<owner>/<repo>=<regexp>' patterns with a (?P<version>...) group which tags must match after stripping their prefix; other tags are ignored (env: PYPIHUB_REPO_TAG_PATTERNS)"`
+	Packages             []string      `arg:"--package,help:list of '<owner>/<repo>=<project>:<subdirectory>[:<tag pattern>]' Python packages living in subdirectories of a repo; tags match '^<project>/(?P<version>.+)$' by default (env: PYPIHUB_PACKAGES)"`
+	Sdists               bool          `arg:"--sdists,env:PYPIHUB_SDISTS,help:repackage tag archives into sdists named as per PEP 625 with a PKG-INFO generated from the static metadata in pyproject.toml or setup.cfg (env: PYPIHUB_SDISTS)"`
+	ArchiveCache         string        `arg:"--archive-cache,env:PYPIHUB_ARCHIVE_CACHE,help:directory to keep rewritten tag archives in so their contents and hashes stay the same across restarts; losing it changes their hashes (default: '$XDG_STATE_HOME/pypihub/archives' or '~/.local/state/pypihub/archives') (env: PYPIHUB_ARCHIVE_CACHE)"`
+	RepoDeliveries       []string      `arg:"--repo-delivery,help:list of '<owner>/<repo>=<proxy|redirect>' delivery mode overrides for specific repos (env: PYPIHUB_REPO_DELIVERIES)"`
+	CacheRedirects       bool          `arg:"--cache-redirects,env:PYPIHUB_CACHE_REDIRECTS,help:reuse GitHub download URLs in redirect mode until they expire (env: PYPIHUB_CACHE_REDIRECTS)"`
+	Htpasswd             string        `arg:"--htpasswd,env:PYPIHUB_HTPASSWD,help:htpasswd file of users allowed to access pypihub with HTTP basic auth; it is reloaded when it changes (env: PYPIHUB_HTPASSWD)"`
+	TokensFile           string        `arg:"--tokens-file,env:PYPIHUB_TOKENS_FILE,help:JSON file of API tokens and the repos they may read; tokens created with the admin API are saved to it (env: PYPIHUB_TOKENS_FILE)"`
+	GitHubAuth           bool          `arg:"--github-auth,env:PYPIHUB_GITHUB_AUTH,help:let clients authenticate with their own GitHub token as the basic auth password and only show them the repos it can read (env: PYPIHUB_GITHUB_AUTH)"`
+	GitHubAuthTTL        time.Duration `arg:"--github-auth-ttl,env:PYPIHUB_GITHUB_AUTH_TTL,help:how long to cache which repos a GitHub token can read (default: 5m) (env: PYPIHUB_GITHUB_AUTH_TTL)"`
+	OIDCIssuer           string        `arg:"--oidc-issuer,env:PYPIHUB_OIDC_ISSUER,help:issuer of OIDC/JWT bearer tokens to accept e.g. 'https://token.actions.githubusercontent.com' (env: PYPIHUB_OIDC_ISSUER)"`
+	OIDCAudience         string        `arg:"--oidc-audience,env:PYPIHUB_OIDC_AUDIENCE,help:audience OIDC tokens must be issued for (env: PYPIHUB_OIDC_AUDIENCE)"`
+	OIDCJWKS             string        `arg:"--oidc-jwks,env:PYPIHUB_OIDC_JWKS,help:URL or file of the JWKS to verify OIDC tokens with (default: discovered from the issuer) (env: PYPIHUB_OIDC_JWKS)"`
+	OIDCRules            []string      `arg:"--oidc-rule,help:list of '<claim> == <value> [&& ...] => <grant> [<grant> ...]' rules granting OIDC tokens read access (env: PYPIHUB_OIDC_RULES separated by ';')"`
+	AuthExempt           []string      `arg:"--auth-exempt,help:list of paths which do not require authentication e.g. '/healthz' (env: PYPIHUB_AUTH_EXEMPT)"`
+	AdminToken           string        `arg:"--admin-token,env:PYPIHUB_ADMIN_TOKEN,help:bearer token required to use the /admin endpoints; they are disabled when unset (env: PYPIHUB_ADMIN_TOKEN)"`
+	LogFormat            string        `arg:"--log-format,env:PYPIHUB_LOG_FORMAT,help:format of log records: 'logfmt' or 'json' (default: 'logfmt') (env: PYPIHUB_LOG_FORMAT)"`
+	LogLevel             string        `arg:"--log-level,env:PYPIHUB_LOG_LEVEL,help:minimum level of log records to write: 'debug' 'info' 'warn' or 'error' (default: 'info') (env: PYPIHUB_LOG_LEVEL)"`
+	TraceExporter        string        `arg:"--trace-exporter,env:PYPIHUB_TRACE_EXPORTER,help:where to send OpenTelemetry traces: 'none' 'otlp' or 'stdout' (default: 'none') (env: PYPIHUB_TRACE_EXPORTER)"`
+	TraceEndpoint        string        `arg:"--trace-endpoint,env:PYPIHUB_TRACE_ENDPOINT,help:OTLP/HTTP endpoint to send traces to (default: 'http://localhost:4318/v1/traces') (env: PYPIHUB_TRACE_ENDPOINT)"`
+	TraceSampleRatio     float64       `arg:"--trace-sample-ratio,env:PYPIHUB_TRACE_SAMPLE_RATIO,help:fraction of new traces to record between 0 and 1; traces continued from a caller follow the caller's decision (default: 1) (env: PYPIHUB_TRACE_SAMPLE_RATIO)"`
+	MetricsBind          string        `arg:"--metrics-bind,env:PYPIHUB_METRICS_BIND,help:[<address>]:<port> to serve Prometheus /metrics on instead of the main listener (env: PYPIHUB_METRICS_BIND)"`
+	Templates            string        `arg:"--templates,env:PYPIHUB_TEMPLATES,help:directory of custom page templates (simple-index.html simple-project.html projects.html project.html) and a style.css stylesheet (env: PYPIHUB_TEMPLATES)"`
+	AuditLog             string        `arg:"--audit-log,env:PYPIHUB_AUDIT_LOG,help:file to write a JSON lines audit record of every download to or '-' for stdout (env: PYPIHUB_AUDIT_LOG)"`
+	AuditLogMaxSize      int64         `arg:"--audit-log-max-size,env:PYPIHUB_AUDIT_LOG_MAX_SIZE,help:rotate the audit log once it grows over this many megabytes; 0 to never rotate by size (default: 100) (env: PYPIHUB_AUDIT_LOG_MAX_SIZE)"`
+	AuditLogMaxAge       time.Duration `arg:"--audit-log-max-age,env:PYPIHUB_AUDIT_LOG_MAX_AGE,help:rotate the audit log once it has been written to for this long; 0 to never rotate by age (default: 24h) (env: PYPIHUB_AUDIT_LOG_MAX_AGE)"`
+	AuditLogMaxFiles     int           `arg:"--audit-log-max-files,env:PYPIHUB_AUDIT_LOG_MAX_FILES,help:number of rotated audit logs to keep; 0 to keep them all (default: 10) (env: PYPIHUB_AUDIT_LOG_MAX_FILES)"`
+	NoMetadata           bool          `arg:"--no-metadata,env:PYPIHUB_NO_METADATA,help:don't read package metadata from wheels and sdists; it is read once per asset using range requests for wheels and by downloading sdists (env: PYPIHUB_NO_METADATA)"`
+	TrustedProxies       []string      `arg:"--trusted-proxy,help:list of proxy addresses or CIDR ranges whose X-Forwarded-For and X-Real-IP headers are trusted for client addresses (env: PYPIHUB_TRUSTED_PROXIES)"`
+
+	repoIntervals  map[string]time.Duration `arg:"-"`
+	repoDeliveries map[string]string        `arg:"-"`
+	versionRules   map[string]versionRule   `arg:"-"`
+	packages       map[string][]repoPackage `arg:"-"`
+	trustedProxies []*net.IPNet             `arg:"-"`
+	accessToken    secret                   `arg:"-"`
+	adminToken     secret                   `arg:"-"`
+	logLevel       slog.Level               `arg:"-"`
 }
 
+const (
+	// DeliveryProxy streams downloads from GitHub through pypihub
+	DeliveryProxy = "proxy"
+	// DeliveryRedirect redirects clients to download directly from GitHub
+	DeliveryRedirect = "redirect"
+)
+
 func (c Config) Version() string {
 	return fmt.Sprintf("pypihub %s", VERSION)
 }
 
-func ParseConfig() Config {
-	var config = Config{
-		Bind:      ":8287",
-		RepoNames: make([]string, 0),
+type GenerateConfig struct {
+	Out     string `arg:"-o,--out,required,help:directory to write the generated site into"`
+	JSON    bool   `arg:"--json,help:also write PEP 691 JSON index files (index.json) next to each simple index page"`
+	BaseURL string `arg:"--base-url,help:URL the site will be served from; used for the install commands on project pages"`
+}
+
+func newConfig() Config {
+	return Config{
+		Bind:             ":8287",
+		RepoNames:        make([]string, 0),
+		RefreshInterval:  5 * time.Minute,
+		RefreshJitter:    30 * time.Second,
+		MaxSnapshotAge:   30 * time.Minute,
+		ReadTimeout:      30 * time.Second,
+		IdleTimeout:      2 * time.Minute,
+		ShutdownTimeout:  30 * time.Second,
+		Delivery:         DeliveryProxy,
+		GitHubAuthTTL:    5 * time.Minute,
+		AuditLogMaxSize:  100,
+		AuditLogMaxAge:   24 * time.Hour,
+		AuditLogMaxFiles: 10,
+		SecretCommandTTL: 5 * time.Minute,
+		LogFormat:        LogFormatLogfmt,
+		LogLevel:         "info",
+		TraceExporter:    TraceExporterNone,
+		TraceEndpoint:    "http://localhost:4318/v1/traces",
+		TraceSampleRatio: 1,
 	}
+}
 
-	arg.MustParse(&config)
+// defaultArchiveCache returns the directory rewritten archives are kept in,
+// which has to outlive reboots so their hashes stay the same, or "" when
+// there is no state directory
+func defaultArchiveCache() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "pypihub", "archives")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "pypihub", "archives")
+	}
+	return ""
+}
 
+func (c Config) normalize() (Config, error) {
 	if val, ok := os.LookupEnv("PYPIHUB_REPOS"); ok {
-		config.RepoNames = append(config.RepoNames, strings.Split(val, " ")...)
+		c.RepoNames = append(c.RepoNames, strings.Split(val, " ")...)
+	}
+	for i := range c.RepoNames {
+		c.RepoNames[i] = strings.TrimSpace(c.RepoNames[i])
+	}
+
+	c.RepoNames = uniqueSlice(removeEmpty(c.RepoNames))
+	if len(c.RepoNames) == 0 {
+		return c, fmt.Errorf("at least one '<owner>/<repo>' repo is required (or PYPIHUB_REPOS)")
+	}
+
+	if c.RefreshInterval <= 0 {
+		return c, fmt.Errorf("--refresh-interval must be greater than 0")
+	}
+	if c.RefreshJitter < 0 {
+		return c, fmt.Errorf("--refresh-jitter must not be negative")
+	}
+	if c.MaxSnapshotAge <= 0 {
+		return c, fmt.Errorf("--max-snapshot-age must be greater than 0")
+	}
+	if c.GitHubAuthTTL < 0 {
+		return c, fmt.Errorf("--github-auth-ttl must not be negative")
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 || c.ShutdownTimeout < 0 {
+		return c, fmt.Errorf("timeouts must not be negative")
+	}
+
+	if val, ok := os.LookupEnv("PYPIHUB_AUTH_EXEMPT"); ok {
+		c.AuthExempt = append(c.AuthExempt, strings.Split(val, " ")...)
+	}
+	c.AuthExempt = removeEmpty(c.AuthExempt)
+
+	if val, ok := os.LookupEnv("PYPIHUB_OIDC_RULES"); ok {
+		c.OIDCRules = append(c.OIDCRules, strings.Split(val, ";")...)
+	}
+	for i := range c.OIDCRules {
+		c.OIDCRules[i] = strings.TrimSpace(c.OIDCRules[i])
+	}
+	c.OIDCRules = removeEmpty(c.OIDCRules)
+	if val, ok := os.LookupEnv("PYPIHUB_TLS_CLIENT_RULES"); ok {
+		c.TLSClientRules = append(c.TLSClientRules, strings.Split(val, ";")...)
+	}
+	for i := range c.TLSClientRules {
+		c.TLSClientRules[i] = strings.TrimSpace(c.TLSClientRules[i])
+	}
+	c.TLSClientRules = removeEmpty(c.TLSClientRules)
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return c, fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if c.TLSCert == "" && (c.TLSClientCA != "" || c.HTTPRedirectBind != "") {
+		return c, fmt.Errorf("--tls-cert is required for --tls-client-ca and --http-redirect-bind")
+	}
+	if c.TLSClientCA == "" && (c.TLSRequireClientCert || len(c.TLSClientRules) > 0) {
+		return c, fmt.Errorf("--tls-client-ca is required for --tls-require-client-cert and --tls-client-rule")
+	}
+
+	if c.OIDCIssuer == "" && (c.OIDCJWKS != "" || len(c.OIDCRules) > 0) {
+		return c, fmt.Errorf("--oidc-issuer is required to use OIDC authentication")
+	}
+
+	if c.AuditLogMaxSize < 0 || c.AuditLogMaxAge < 0 || c.AuditLogMaxFiles < 0 {
+		return c, fmt.Errorf("--audit-log-max-size, --audit-log-max-age and --audit-log-max-files must not be negative")
+	}
+
+	if val, ok := os.LookupEnv("PYPIHUB_TRUSTED_PROXIES"); ok {
+		c.TrustedProxies = append(c.TrustedProxies, strings.Split(val, " ")...)
+	}
+	c.TrustedProxies = removeEmpty(c.TrustedProxies)
+
+	var overrides map[string]string
+	var err error
+	if c.LogFormat != LogFormatLogfmt && c.LogFormat != LogFormatJSON {
+		return c, fmt.Errorf("invalid --log-format: unknown format %q, expected %q or %q", c.LogFormat, LogFormatLogfmt, LogFormatJSON)
+	}
+	if c.logLevel, err = parseLogLevel(c.LogLevel); err != nil {
+		return c, fmt.Errorf("invalid --log-level: %s", err)
+	}
+	switch c.TraceExporter {
+	case TraceExporterNone, TraceExporterOTLP, TraceExporterStdout:
+	default:
+		return c, fmt.Errorf("invalid --trace-exporter: unknown exporter %q, expected %q %q or %q", c.TraceExporter, TraceExporterNone, TraceExporterOTLP, TraceExporterStdout)
+	}
+	if c.TraceExporter == TraceExporterOTLP {
+		if u, err := url.Parse(c.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c, fmt.Errorf("invalid --trace-endpoint: %q is not an http(s) URL", c.TraceEndpoint)
+		}
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return c, fmt.Errorf("--trace-sample-ratio must be between 0 and 1")
+	}
+	if c.SecretCommandTTL < 0 {
+		return c, fmt.Errorf("--secret-command-ttl must not be negative")
+	}
+	c.accessToken, err = newSecret("access-token", c.AccessToken, c.AccessTokenFile, c.AccessTokenCommand, c.SecretCommandTTL)
+	if err != nil {
+		return c, err
+	}
+	if c.accessToken == nil {
+		return c, fmt.Errorf("one of --access-token, --access-token-file or --access-token-command is required")
+	}
+	c.adminToken, err = newSecret("admin-token", c.AdminToken, c.AdminTokenFile, c.AdminTokenCommand, c.SecretCommandTTL)
+	if err != nil {
+		return c, err
+	}
+
+	if c.trustedProxies, err = parseCIDRs(c.TrustedProxies); err != nil {
+		return c, fmt.Errorf("invalid --trusted-proxy: %s", err)
+	}
+	overrides, err = c.parseRepoOverrides("PYPIHUB_REPO_INTERVALS", c.RepoIntervals)
+	if err != nil {
+		return c, fmt.Errorf("invalid --repo-interval: %s", err)
+	}
+	c.repoIntervals = make(map[string]time.Duration)
+	for repo, v := range overrides {
+		var d time.Duration
+		d, err = time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("invalid --repo-interval for %s: %q is not a positive duration like '1m'", repo, v)
+		}
+		c.repoIntervals[repo] = d
+	}
+
+	if c.Delivery, err = parseDelivery(c.Delivery); err != nil {
+		return c, fmt.Errorf("invalid --delivery: %s", err)
+	}
+	overrides, err = c.parseRepoOverrides("PYPIHUB_REPO_DELIVERIES", c.RepoDeliveries)
+	if err != nil {
+		return c, fmt.Errorf("invalid --repo-delivery: %s", err)
 	}
-	for i := range config.RepoNames {
-		config.RepoNames[i] = strings.TrimSpace(config.RepoNames[i])
+	c.repoDeliveries = make(map[string]string)
+	for repo, v := range overrides {
+		if c.repoDeliveries[repo], err = parseDelivery(v); err != nil {
+			return c, fmt.Errorf("invalid --repo-delivery for %s: %s", repo, err)
+		}
 	}
 
-	config.RepoNames = uniqueSlice(config.RepoNames)
+	if c.versionRules, err = c.parseVersionRules(); err != nil {
+		return c, err
+	}
+	if c.packages, err = c.parsePackages(c.Packages); err != nil {
+		return c, fmt.Errorf("invalid --package: %s", err)
+	}
+	if c.ArchiveCache == "" {
+		c.ArchiveCache = defaultArchiveCache()
+	}
+	if c.ArchiveCache == "" && (c.Sdists || len(c.packages) > 0) {
+		return c, fmt.Errorf("--archive-cache is required with --sdists or --package as there is no home directory to keep rewritten archives in")
+	}
+
+	return c, nil
+}
+
+// parseVersionRules builds the version rules of every repo with a
+// --repo-version-from --repo-tag-prefix or --repo-tag-pattern override
+func (c Config) parseVersionRules() (map[string]versionRule, error) {
+	var rules = make(map[string]versionRule)
+	var rule = func(repo string) versionRule {
+		if r, ok := rules[repo]; ok {
+			return r
+		}
+		return defaultVersionRule
+	}
+
+	var overrides, err = c.parseRepoOverrides("PYPIHUB_REPO_VERSION_FROM", c.RepoVersionFrom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --repo-version-from: %s", err)
+	}
+	for repo, v := range overrides {
+		var r = rule(repo)
+		if r.from, err = parseVersionFrom(v); err != nil {
+			return nil, fmt.Errorf("invalid --repo-version-from for %s: %s", repo, err)
+		}
+		rules[repo] = r
+	}
+
+	overrides, err = c.parseRepoOverrides("PYPIHUB_REPO_TAG_PREFIXES", c.RepoTagPrefixes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --repo-tag-prefix: %s", err)
+	}
+	for repo, v := range overrides {
+		var r = rule(repo)
+		r.prefix = v
+		rules[repo] = r
+	}
+
+	overrides, err = c.parseRepoOverrides("PYPIHUB_REPO_TAG_PATTERNS", c.RepoTagPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --repo-tag-pattern: %s", err)
+	}
+	for repo, v := range overrides {
+		var r = rule(repo)
+		if r.pattern, err = parseTagPattern(v); err != nil {
+			return nil, fmt.Errorf("invalid --repo-tag-pattern for %s: %s", repo, err)
+		}
+		rules[repo] = r
+	}
+	return rules, nil
+}
+
+// parseRepoOverrides parses a list of '<owner>/<repo>=<value>' flag values,
+// plus any space separated ones from the environment variable env, into a
+// map of repo key to value
+func (c Config) parseRepoOverrides(env string, values []string) (map[string]string, error) {
+	if val, ok := os.LookupEnv(env); ok {
+		values = append(values, strings.Split(val, " ")...)
+	}
+
+	var overrides = make(map[string]string)
+	for _, v := range removeEmpty(values) {
+		var p = strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("%q, expected '<owner>/<repo>=<value>'", v)
+		}
+		overrides[c.repoKey(p[0])] = p[1]
+	}
+	return overrides, nil
+}
+
+func parseDelivery(d string) (string, error) {
+	switch d {
+	case "":
+		return DeliveryProxy, nil
+	case DeliveryProxy, DeliveryRedirect:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown delivery mode %q, expected %q or %q", d, DeliveryProxy, DeliveryRedirect)
+	}
+}
+
+func (c Config) splitRepoName(r string) (string, string) {
+	var p = strings.SplitN(r, "/", 2)
+	switch len(p) {
+	case 2:
+		return p[0], p[1]
+	case 1:
+		return c.Username, p[0]
+	default:
+		return "", ""
+	}
+}
+
+// repoKey returns the canonical, case insensitive '<owner>/<repo>' name of a configured repo
+func (c Config) repoKey(r string) string {
+	var owner, repo = c.splitRepoName(r)
+	return strings.ToLower(fmt.Sprintf("%s/%s", owner, repo))
+}
+
+// RepoInterval returns how often the repo r should be refetched
+func (c Config) RepoInterval(r string) time.Duration {
+	if d, ok := c.repoIntervals[c.repoKey(r)]; ok {
+		return d
+	}
+	return c.RefreshInterval
+}
 
+// RepoDelivery returns how downloads for the repo r should be delivered
+func (c Config) RepoDelivery(r string) string {
+	if d, ok := c.repoDeliveries[c.repoKey(r)]; ok {
+		return d
+	}
+	return c.Delivery
+}
+
+// versionRule returns how versions are derived from the tags of the repo r
+func (c Config) versionRule(r string) versionRule {
+	if rule, ok := c.versionRules[c.repoKey(r)]; ok {
+		return rule
+	}
+	return defaultVersionRule
+}
+
+func mustParse(program string, args []string, dests ...interface{}) *arg.Parser {
+	var p *arg.Parser
+	var err error
+	p, err = arg.NewParser(arg.Config{Program: program}, dests...)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	err = p.Parse(args)
+	switch err {
+	case nil:
+		return p
+	case arg.ErrHelp:
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	case arg.ErrVersion:
+		fmt.Println(dests[0].(arg.Versioned).Version())
+		os.Exit(0)
+	default:
+		p.Fail(err.Error())
+	}
+	return p
+}
+
+func ParseConfig() Config {
+	var config = newConfig()
+	var p = mustParse("pypihub", os.Args[1:], &config)
+
+	var err error
+	config, err = config.normalize()
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	setupLogging(config)
+	if err = setupTracing(config); err != nil {
+		p.Fail(err.Error())
+	}
 	return config
 }
+
+func ParseGenerateConfig() (Config, GenerateConfig) {
+	var config = newConfig()
+	var gen GenerateConfig
+	var p = mustParse("pypihub generate", os.Args[2:], &config, &gen)
+
+	var err error
+	config, err = config.normalize()
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	setupLogging(config)
+	if err = setupTracing(config); err != nil {
+		p.Fail(err.Error())
+	}
+	return config, gen
+}
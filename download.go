@@ -0,0 +1,140 @@
+package pypihub
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardRequestHeaders are the client request headers passed on to the upstream download
+var forwardRequestHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// forwardResponseHeaders are the upstream response headers passed on to the client
+var forwardResponseHeaders = []string{
+	"Accept-Ranges",
+	"Content-Length",
+	"Content-Range",
+	"ETag",
+	"Last-Modified",
+}
+
+func contentType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".whl"), strings.HasSuffix(name, ".zip"), strings.HasSuffix(name, ".egg"):
+		return "application/zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "application/gzip"
+	case strings.HasSuffix(name, ".tar.bz2"):
+		return "application/x-bzip2"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// upstreamErrorStatus maps an error talking to GitHub to the status we respond with
+func upstreamErrorStatus(err error) int {
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// findAsset looks up an asset the client making req is allowed to see
+func (r *Router) findAsset(req *http.Request, owner string, repo string, name string) (Asset, bool) {
+	owner = strings.ToLower(owner)
+	repo = strings.ToLower(repo)
+	for _, a := range r.visibleAssets(req) {
+		if strings.ToLower(a.Owner) == owner && strings.ToLower(a.Repo) == repo && a.Name == name {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// serveCoreMetadata serves the METADATA file of the wheel name as '<name>.metadata' (PEP 658)
+func (r *Router) serveCoreMetadata(w http.ResponseWriter, req *http.Request, owner string, repo string, name string) {
+	var a, ok = r.findAsset(req, owner, repo, name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var data, _, found = coreMetadata(a)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, req, a.Name+".metadata", a.Uploaded, bytes.NewReader(data))
+}
+
+// proxyAsset streams the asset from GitHub to the client, forwarding range
+// and conditional requests and the relevant response headers
+func (r *Router) proxyAsset(w http.ResponseWriter, req *http.Request, a Asset) {
+	var header = make(http.Header)
+	// Rewritten archives are always served whole, so they don't take ranges
+	// and are never asked for them
+	if !a.rewritten() {
+		for _, k := range forwardRequestHeaders {
+			if v := req.Header.Get(k); v != "" {
+				header.Set(k, v)
+			}
+		}
+	}
+
+	// Cancel the upstream download if the client goes away
+	var resp *http.Response
+	var err error
+	if req.Method == "HEAD" {
+		resp, err = r.client.Head(req.Context(), a, header)
+	} else {
+		resp, err = r.client.Fetch(req.Context(), a, header)
+	}
+	if err != nil {
+		if req.Context().Err() != nil {
+			return
+		}
+		slog.ErrorContext(req.Context(), "error fetching asset", "asset", a.URL(), "error", err)
+		http.Error(w, http.StatusText(upstreamErrorStatus(err)), upstreamErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		slog.ErrorContext(req.Context(), "error fetching asset", "asset", a.URL(), "error", "unexpected upstream status "+resp.Status)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	for _, k := range forwardResponseHeaders {
+		if v := resp.Header.Get(k); v != "" && (k != "Accept-Ranges" || !a.rewritten()) {
+			w.Header().Set(k, v)
+		}
+	}
+	// 304 and 416 responses don't carry the asset
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		w.Header().Set("Content-Type", contentType(a.Name))
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+strings.Replace(a.Name, "\"", "", -1)+"\"")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if req.Method == "HEAD" {
+		return
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil && req.Context().Err() == nil {
+		slog.WarnContext(req.Context(), "error streaming asset", "asset", a.URL(), "error", err)
+	}
+}
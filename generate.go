@@ -0,0 +1,454 @@
+package pypihub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestName is the file, relative to the output directory, used to
+// remember what a previous run generated so reruns only update what changed
+const manifestName = ".pypihub-manifest.json"
+
+type manifestEntry struct {
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+type manifest struct {
+	Assets map[string]manifestEntry `json:"assets"`
+	Pages  []string                 `json:"pages"`
+}
+
+type Generator struct {
+	config Config
+	gen    GenerateConfig
+	client *Client
+	hashes map[string]string
+	pages  *pageTemplates
+}
+
+func NewGenerator(config Config, gen GenerateConfig) (*Generator, error) {
+	var pages, err = loadPageTemplates(config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	return &Generator{
+		config: config,
+		gen:    gen,
+		client: NewClient(config),
+		hashes: make(map[string]string),
+		pages:  pages,
+	}, nil
+}
+
+// assetSource identifies where the bytes of an asset come from, so we can
+// tell whether a previously downloaded file is still current
+func assetSource(a Asset) string {
+	if a.Ref != "" && a.Format != "" && a.rewritten() {
+		return fmt.Sprintf("%s:%s/%s@%s:%s:%t", a.Format, a.Owner, a.Repo, a.Ref, a.Subdir, a.Sdist)
+	}
+	if a.Ref != "" && a.Format != "" {
+		return fmt.Sprintf("%s:%s/%s@%s", a.Format, a.Owner, a.Repo, a.Ref)
+	}
+	return fmt.Sprintf("asset:%s/%s#%d", a.Owner, a.Repo, a.ID)
+}
+
+func assetPath(a Asset) string {
+	return strings.TrimPrefix(a.URL(), "/")
+}
+
+// relativeLink returns the link to target from a page living in the directory dir
+func relativeLink(dir string, target string) string {
+	var rel, err = filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(target))
+	if err != nil {
+		return "/" + target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rootLink returns the link to the root of the site from a page living in the directory dir
+func rootLink(dir string) string {
+	return relativeLink(dir, ".") + "/"
+}
+
+func (g *Generator) outPath(p string) string {
+	return filepath.Join(g.gen.Out, filepath.FromSlash(p))
+}
+
+func (g *Generator) readManifest() manifest {
+	var m = manifest{Assets: make(map[string]manifestEntry)}
+	var data, err = ioutil.ReadFile(g.outPath(manifestName))
+	if err != nil {
+		return m
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		slog.Warn("ignoring invalid manifest", "path", g.outPath(manifestName), "error", err)
+		return manifest{Assets: make(map[string]manifestEntry)}
+	}
+	if m.Assets == nil {
+		m.Assets = make(map[string]manifestEntry)
+	}
+	return m
+}
+
+func (g *Generator) writeManifest(m manifest) error {
+	var data, err = json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = g.writeFile(manifestName, data)
+	return err
+}
+
+// writeFile writes data to p, relative to the output directory, unless the
+// existing file already has the same contents; it reports whether it wrote
+func (g *Generator) writeFile(p string, data []byte) (bool, error) {
+	var dest = g.outPath(p)
+	if existing, err := ioutil.ReadFile(dest); err == nil && bytes.Equal(existing, data) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	var tmp = dest + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, dest)
+}
+
+// remove deletes the file p of the output directory, logging any failure
+// other than it being gone already
+func (g *Generator) remove(p string) {
+	if err := os.Remove(g.outPath(p)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("error removing stale file", "path", p, "error", err)
+	}
+}
+
+func (g *Generator) downloadAsset(a Asset) (string, error) {
+	var dest = g.outPath(assetPath(a))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	var rc io.ReadCloser
+	var err error
+	rc, err = a.Download(context.Background(), g.client)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	var tmp = dest + ".tmp"
+	var f *os.File
+	f, err = os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	var h = sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), os.Rename(tmp, dest)
+}
+
+func (g *Generator) syncAssets(assets []Asset, prev manifest) (map[string]manifestEntry, error) {
+	var current = make(map[string]manifestEntry)
+	for _, a := range assets {
+		var p = assetPath(a)
+		var src = assetSource(a)
+		if entry, ok := prev.Assets[p]; ok && entry.Source == src {
+			if _, err := os.Stat(g.outPath(p)); err == nil {
+				current[p] = entry
+				g.hashes[a.URL()] = entry.SHA256
+				continue
+			}
+		}
+
+		slog.Info("downloading asset", "path", p)
+		var sum, err = g.downloadAsset(a)
+		if err != nil {
+			return nil, fmt.Errorf("downloading %s: %s", p, err)
+		}
+		current[p] = manifestEntry{Source: src, SHA256: sum}
+		g.hashes[a.URL()] = sum
+	}
+
+	for p := range prev.Assets {
+		if _, ok := current[p]; !ok {
+			slog.Info("removing stale asset", "path", p)
+			g.remove(p)
+		}
+	}
+	return current, nil
+}
+
+// readFileMetadata reads the metadata of the wheel or sdist downloaded to p
+func readFileMetadata(p string) (*Metadata, error) {
+	var f, err = os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if !strings.HasSuffix(p, ".whl") {
+		return readSdistMetadata(f)
+	}
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readWheelMetadata(f, info.Size())
+}
+
+// readMetadata sets the metadata of every downloaded asset we can read it from
+func (g *Generator) readMetadata(assets []Asset) {
+	for i := range assets {
+		if !hasMetadata(assets[i]) {
+			continue
+		}
+		var md, err = readFileMetadata(g.outPath(assetPath(assets[i])))
+		if err != nil {
+			slog.Warn("error reading package metadata", "path", assetPath(assets[i]), "error", err)
+			continue
+		}
+		assets[i].Metadata = md
+	}
+}
+
+// pageAssetLinker links assets relative to the page directory dir, with a
+// hash fragment so pip can verify the download
+func (g *Generator) pageAssetLinker(dir string) assetLinker {
+	return func(a Asset) string {
+		var link = relativeLink(dir, assetPath(a))
+		if h, ok := g.hashes[a.URL()]; ok {
+			link = fmt.Sprintf("%s#sha256=%s", link, h)
+		}
+		return link
+	}
+}
+
+// stylesheet returns the link to the custom stylesheet from a page living in the directory dir
+func (g *Generator) stylesheet(dir string) string {
+	if !g.pages.HasStylesheet() {
+		return ""
+	}
+	return relativeLink(dir, stylesheetPath)
+}
+
+// renderPages renders every page of the site, readmes holds the rendered
+// README of each repo by its lowercased name
+func (g *Generator) renderPages(assets []Asset, releases []Release, readmes map[string]string) (map[string][]byte, error) {
+	var pages = make(map[string][]byte)
+	var buf *bytes.Buffer
+	var err error
+
+	if g.pages.HasStylesheet() {
+		pages[stylesheetPath] = g.pages.css
+	}
+
+	// PEP 658 metadata files live next to their wheels
+	for _, a := range assets {
+		if data, _, ok := coreMetadata(a); ok {
+			pages[assetPath(a)+".metadata"] = data
+		}
+	}
+
+	var projects = projectNames(assets)
+	buf = &bytes.Buffer{}
+	err = g.pages.writeSimpleIndexPage(buf, projects, func(project string) string {
+		return project + "/"
+	}, g.stylesheet("simple"))
+	if err != nil {
+		return nil, err
+	}
+	pages["simple/index.html"] = buf.Bytes()
+
+	if g.gen.JSON {
+		buf = &bytes.Buffer{}
+		if err = writeSimpleIndexJSON(buf, projects); err != nil {
+			return nil, err
+		}
+		pages["simple/index.json"] = buf.Bytes()
+	}
+
+	for _, project := range projects {
+		var dir = path.Join("simple", project)
+		var projectAssets = filterAssets(assets, func(a Asset) bool {
+			return projectName(a) == project
+		})
+
+		buf = &bytes.Buffer{}
+		if err = g.pages.writeSimpleProjectPage(buf, project, projectAssets, g.pageAssetLinker(dir), g.stylesheet(dir)); err != nil {
+			return nil, err
+		}
+		pages[path.Join(dir, "index.html")] = buf.Bytes()
+
+		if g.gen.JSON {
+			buf = &bytes.Buffer{}
+			var link = func(a Asset) string {
+				return relativeLink(dir, assetPath(a))
+			}
+			if err = writeSimpleProjectJSON(buf, project, projectAssets, link, g.hashes); err != nil {
+				return nil, err
+			}
+			pages[path.Join(dir, "index.json")] = buf.Bytes()
+		}
+	}
+
+	// The project list and project pages served at /, /<owner> and /<owner>/<repo>.
+	// Repos with several projects list them and give each its own page.
+	var owners = make(map[string][]Asset)
+	var repos = make(map[string][]Asset)
+	for _, a := range assets {
+		owners[a.Owner] = append(owners[a.Owner], a)
+		var repo = path.Join(a.Owner, a.Repo)
+		repos[repo] = append(repos[repo], a)
+	}
+	var projectPath = func(owner string, repo string, project string) string {
+		var dir = path.Join(owner, repo)
+		if len(projectNames(repos[dir])) > 1 {
+			return path.Join(dir, project+".html")
+		}
+		return path.Join(dir, "index.html")
+	}
+	var writeProjects = func(dir string, title string, assets []Asset) error {
+		var link = func(owner string, repo string, project string) string {
+			var p = projectPath(owner, repo, project)
+			if path.Base(p) == "index.html" {
+				return relativeLink(dir, path.Dir(p)) + "/"
+			}
+			return relativeLink(dir, p)
+		}
+		var buf = &bytes.Buffer{}
+		if err := g.pages.writeProjectsPage(buf, title, title, rootLink(dir), false, "", projectSummaries(assets, releases, "", link), assets, g.pageAssetLinker(dir), g.stylesheet(dir)); err != nil {
+			return err
+		}
+		pages[path.Join(dir, "index.html")] = buf.Bytes()
+		return nil
+	}
+
+	if err = writeProjects("", "Projects", assets); err != nil {
+		return nil, err
+	}
+	for owner, ownerAssets := range owners {
+		if err = writeProjects(owner, fmt.Sprintf("Projects by %s", owner), ownerAssets); err != nil {
+			return nil, err
+		}
+	}
+	for repo, repoAssets := range repos {
+		var projects = projectNames(repoAssets)
+		if len(projects) > 1 {
+			if err = writeProjects(repo, fmt.Sprintf("Projects in %s", repo), repoAssets); err != nil {
+				return nil, err
+			}
+		}
+		for _, project := range projects {
+			var projectAssets = filterAssets(repoAssets, func(a Asset) bool {
+				return projectName(a) == project
+			})
+			var install = func(version string) string {
+				// Without --base-url we don't know where the index will be served from
+				if g.gen.BaseURL == "" {
+					return ""
+				}
+				var spec = project
+				if version != "" {
+					spec += "==" + version
+				}
+				return fmt.Sprintf("pip install --extra-index-url %s/simple/ %s", strings.TrimSuffix(g.gen.BaseURL, "/"), spec)
+			}
+			var a = projectAssets[0]
+			buf = &bytes.Buffer{}
+			var data = projectPage(project, projectAssets, releases, readmes[repoOf(a.Owner, a.Repo)], rootLink(repo), g.pageAssetLinker(repo), install, g.stylesheet(repo))
+			if err = g.pages.writeProjectPage(buf, data); err != nil {
+				return nil, err
+			}
+			pages[projectPath(a.Owner, a.Repo, project)] = buf.Bytes()
+		}
+	}
+
+	return pages, nil
+}
+
+// Run fetches all assets for the configured repos and renders the index
+// into the output directory, only touching files whose contents changed
+func (g *Generator) Run() error {
+	slog.Info("fetching assets", "repos", len(g.config.RepoNames))
+	var assets = make([]Asset, 0)
+	var releases = make([]Release, 0)
+	var readmes = make(map[string]string)
+	for _, r := range g.config.RepoNames {
+		var snapshot, err = g.client.GetRepo(context.Background(), r)
+		if err != nil {
+			return err
+		}
+		g.client.pruneArchives(r, snapshot.Assets)
+		assets = append(assets, snapshot.Assets...)
+		releases = append(releases, snapshot.Releases...)
+		var owner, repo = g.client.splitRepoName(r)
+		readmes[repoOf(owner, repo)] = snapshot.Readme
+	}
+	slog.Info("found assets", "assets", len(assets), "repos", len(g.config.RepoNames))
+
+	var prev = g.readManifest()
+	var next = manifest{Pages: make([]string, 0)}
+	var err error
+	next.Assets, err = g.syncAssets(assets, prev)
+	if err != nil {
+		return err
+	}
+	if !g.config.NoMetadata {
+		g.readMetadata(assets)
+	}
+
+	var pages map[string][]byte
+	pages, err = g.renderPages(assets, releases, readmes)
+	if err != nil {
+		return err
+	}
+
+	var written = 0
+	for p, data := range pages {
+		var changed bool
+		changed, err = g.writeFile(p, data)
+		if err != nil {
+			return err
+		}
+		if changed {
+			written++
+		}
+		next.Pages = append(next.Pages, p)
+	}
+	for _, p := range prev.Pages {
+		if _, ok := pages[p]; !ok {
+			slog.Info("removing stale page", "path", p)
+			g.remove(p)
+		}
+	}
+	slog.Info("wrote pages", "written", written, "pages", len(pages), "out", g.gen.Out)
+
+	sort.Strings(next.Pages)
+	return g.writeManifest(next)
+}
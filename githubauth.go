@@ -0,0 +1,149 @@
+package pypihub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+type githubAuthEntry struct {
+	identity *Identity
+	expires  time.Time
+}
+
+// githubAuthenticator lets clients authenticate with their own GitHub token
+// as the basic auth password, granting them read access to exactly the
+// configured repos that token can read on GitHub
+type githubAuthenticator struct {
+	config Config
+	client *Client
+
+	mu    sync.Mutex
+	cache map[string]githubAuthEntry
+}
+
+func newGitHubAuthenticator(config Config, client *Client) *githubAuthenticator {
+	return &githubAuthenticator{
+		config: config,
+		client: client,
+		cache:  make(map[string]githubAuthEntry),
+	}
+}
+
+func (g *githubAuthenticator) cached(key string) (*Identity, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var entry, ok = g.cache[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.identity, true
+}
+
+func (g *githubAuthenticator) store(key string, id *Identity) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var now = time.Now()
+	for k, entry := range g.cache {
+		if now.After(entry.expires) {
+			delete(g.cache, k)
+		}
+	}
+	g.cache[key] = githubAuthEntry{
+		identity: id,
+		expires:  now.Add(g.config.GitHubAuthTTL),
+	}
+}
+
+func githubStatus(err error) int {
+	if gerr, ok := err.(*github.ErrorResponse); ok && gerr.Response != nil {
+		return gerr.Response.StatusCode
+	}
+	return 0
+}
+
+func githubGet(ctx context.Context, gh *github.Client, u string, v interface{}) error {
+	var req, err = gh.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	_, err = gh.Do(req.WithContext(ctx), v)
+	return err
+}
+
+// check asks GitHub who the token belongs to and which of the configured repos
+// it can read; it returns a nil identity for tokens GitHub rejects
+func (g *githubAuthenticator) check(ctx context.Context, user string, token string) (*Identity, error) {
+	var t = github.BasicAuthTransport{
+		Username:  user,
+		Password:  token,
+		Transport: &propagatingTransport{next: http.DefaultTransport},
+	}
+	var gh = github.NewClient(&http.Client{
+		Transport: &instrumentedTransport{next: &t, metrics: g.client.upstream},
+	})
+	gh.BaseURL = g.client.client.BaseURL
+
+	var u github.User
+	var err = githubGet(ctx, gh, "user", &u)
+	if err != nil {
+		if githubStatus(err) == http.StatusUnauthorized {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var id = &Identity{
+		Name:   user,
+		Method: "github",
+		Grants: make([]Grant, 0),
+	}
+	if u.Login != nil {
+		id.Name = *u.Login
+	}
+	for _, name := range g.config.RepoNames {
+		var owner, repo = g.config.splitRepoName(name)
+		err = githubGet(ctx, gh, fmt.Sprintf("repos/%s/%s", owner, repo), &github.Repository{})
+		switch githubStatus(err) {
+		case 0:
+			if err != nil {
+				return nil, err
+			}
+			id.Grants = append(id.Grants, Grant(strings.ToLower(owner+"/"+repo)))
+		case http.StatusNotFound, http.StatusForbidden:
+			// The token can't read this repo
+		default:
+			return nil, err
+		}
+	}
+	return id, nil
+}
+
+func (g *githubAuthenticator) Authenticate(req *http.Request) *Identity {
+	var user, token, ok = req.BasicAuth()
+	if !ok || token == "" {
+		return nil
+	}
+
+	var key = hashToken(user + ":" + token)
+	if id, ok := g.cached(key); ok {
+		return id
+	}
+
+	var id, err = g.check(req.Context(), user, token)
+	if err != nil {
+		// Don't cache errors talking to GitHub, the next request can try again
+		slog.ErrorContext(req.Context(), "error checking GitHub access", "user", user, "error", err)
+		return nil
+	}
+	g.store(key, id)
+	return id
+}
@@ -0,0 +1,67 @@
+package pypihub
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Status struct {
+	Version     string       `json:"version"`
+	Ready       bool         `json:"ready"`
+	LastSuccess *time.Time   `json:"last_success"`
+	Assets      int          `json:"assets"`
+	RateLimit   RateLimit    `json:"rate_limit"`
+	Repos       []RepoStatus `json:"repos"`
+}
+
+// ready reports whether the router has a recent enough snapshot of assets to serve from
+func (r *Router) ready() (bool, string) {
+	// Every repo needs a recent snapshot, not just one of them
+	var repo, last = r.syncer.LastSuccess()
+	if last.IsZero() {
+		return false, fmt.Sprintf("no successful sync of %s yet", repo)
+	}
+
+	var age = time.Since(last)
+	if age > r.config.MaxSnapshotAge {
+		return false, fmt.Sprintf("last successful sync of %s was %s ago", repo, age.Truncate(time.Second))
+	}
+	return true, "ok"
+}
+
+func (r *Router) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (r *Router) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	var ok, reason = r.ready()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, reason)
+}
+
+func (r *Router) handleStatus(w http.ResponseWriter, req *http.Request) {
+	var status = Status{
+		Version:   VERSION,
+		Assets:    len(r.visibleAssets(req)),
+		RateLimit: r.client.RateLimit(),
+		Repos:     make([]RepoStatus, 0),
+	}
+
+	// Only show the repos the client is allowed to see
+	var id = RequestIdentity(req)
+	for _, rs := range r.syncer.Status() {
+		var p = strings.SplitN(rs.Repo, "/", 2)
+		if id.CanRead(Asset{Owner: p[0], Repo: p[1]}) {
+			status.Repos = append(status.Repos, rs)
+		}
+	}
+	status.Ready, _ = r.ready()
+	if _, last := r.syncer.LastSuccess(); !last.IsZero() {
+		status.LastSuccess = &last
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,182 @@
+package pypihub
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// htpasswdCheckInterval is how often we look for changes to the htpasswd file
+	htpasswdCheckInterval = time.Second
+	// htpasswdCacheTTL is how long a correct password is remembered, so bcrypt
+	// doesn't have to run for every request of a client
+	htpasswdCacheTTL = time.Minute
+	// htpasswdCacheSize is how many passwords are remembered at most
+	htpasswdCacheSize = 1024
+)
+
+// htpasswd verifies usernames and passwords against an htpasswd file,
+// reloading it whenever it changes on disk
+type htpasswd struct {
+	path string
+
+	mu        sync.Mutex
+	users     map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+	// verified maps sha256(user:password) of correct passwords to when they expire
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newHtpasswd(path string) (*htpasswd, error) {
+	var h = &htpasswd{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load must be called with h.mu held, or before h is shared
+func (h *htpasswd) load() error {
+	var f, err = os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var users = make(map[string]string)
+	var scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p = strings.SplitN(line, ":", 2)
+		if len(p) != 2 {
+			continue
+		}
+		if !supportedHash(p[1]) {
+			slog.Warn("ignoring htpasswd entry, only bcrypt and {SHA} hashes are supported", "user", p[0])
+			continue
+		}
+		users[p[0]] = p[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	h.users = users
+	h.verified = make(map[[sha256.Size]byte]time.Time)
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	return nil
+}
+
+// reload reloads the file if it changed since we last loaded it, if the
+// file can't be read we keep using the users we already have
+func (h *htpasswd) reload() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.lastCheck) < htpasswdCheckInterval {
+		return
+	}
+	h.lastCheck = time.Now()
+
+	var info, err = os.Stat(h.path)
+	if err != nil {
+		slog.Error("error checking htpasswd file", "path", h.path, "error", err)
+		return
+	}
+	if info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return
+	}
+
+	if err = h.load(); err != nil {
+		slog.Error("error reloading htpasswd file", "path", h.path, "error", err)
+		return
+	}
+	slog.Info("reloaded htpasswd file", "path", h.path, "users", len(h.users))
+}
+
+// Verify reports whether password is correct for user
+func (h *htpasswd) Verify(user string, password string) bool {
+	h.reload()
+
+	var key = sha256.Sum256([]byte(user + ":" + password))
+	h.mu.Lock()
+	var hash, ok = h.users[user]
+	var expires, cached = h.verified[key]
+	h.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if cached && time.Now().Before(expires) {
+		return true
+	}
+	if !verifyHash(hash, password) {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.verified) >= htpasswdCacheSize {
+		var now = time.Now()
+		for k, exp := range h.verified {
+			if now.After(exp) {
+				delete(h.verified, k)
+			}
+		}
+		if len(h.verified) >= htpasswdCacheSize {
+			h.verified = make(map[[sha256.Size]byte]time.Time)
+		}
+	}
+	// Users removed by a reload in the meantime stay removed
+	if h.users[user] == hash {
+		h.verified[key] = time.Now().Add(htpasswdCacheTTL)
+	}
+	return true
+}
+
+func (h *htpasswd) Authenticate(req *http.Request) *Identity {
+	var user, password, ok = req.BasicAuth()
+	if !ok || !h.Verify(user, password) {
+		return nil
+	}
+	return &Identity{Name: user, Method: "basic"}
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "{SHA}")
+}
+
+func verifyHash(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		var sum = sha1.Sum([]byte(password))
+		var expected = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,252 @@
+package pypihub
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brettlangdon/pypihub/pep440"
+	"github.com/gorilla/mux"
+)
+
+// PyPI JSON API structures, see https://docs.pypi.org/api/json/
+type pypiInfo struct {
+	Author                 string            `json:"author"`
+	AuthorEmail            string            `json:"author_email"`
+	Classifiers            []string          `json:"classifiers"`
+	Description            string            `json:"description"`
+	DescriptionContentType *string           `json:"description_content_type"`
+	HomePage               string            `json:"home_page"`
+	Keywords               string            `json:"keywords"`
+	License                string            `json:"license"`
+	Maintainer             string            `json:"maintainer"`
+	MaintainerEmail        string            `json:"maintainer_email"`
+	Name                   string            `json:"name"`
+	PackageURL             string            `json:"package_url"`
+	ProjectURL             string            `json:"project_url"`
+	ProjectURLs            map[string]string `json:"project_urls"`
+	ReleaseURL             string            `json:"release_url"`
+	RequiresDist           []string          `json:"requires_dist"`
+	RequiresPython         *string           `json:"requires_python"`
+	Summary                string            `json:"summary"`
+	Version                string            `json:"version"`
+	Yanked                 bool              `json:"yanked"`
+	YankedReason           *string           `json:"yanked_reason"`
+}
+
+type pypiFile struct {
+	CommentText       string            `json:"comment_text"`
+	Digests           map[string]string `json:"digests"`
+	Downloads         int               `json:"downloads"`
+	Filename          string            `json:"filename"`
+	HasSig            bool              `json:"has_sig"`
+	MD5Digest         string            `json:"md5_digest"`
+	PackageType       string            `json:"packagetype"`
+	PythonVersion     string            `json:"python_version"`
+	RequiresPython    *string           `json:"requires_python"`
+	Size              int               `json:"size"`
+	UploadTime        *string           `json:"upload_time"`
+	UploadTimeISO8601 *string           `json:"upload_time_iso_8601"`
+	URL               string            `json:"url"`
+	Yanked            bool              `json:"yanked"`
+	YankedReason      *string           `json:"yanked_reason"`
+}
+
+type pypiProject struct {
+	Info            pypiInfo              `json:"info"`
+	Releases        map[string][]pypiFile `json:"releases,omitempty"`
+	URLs            []pypiFile            `json:"urls"`
+	Vulnerabilities []interface{}         `json:"vulnerabilities"`
+}
+
+// packageType returns the PyPI packagetype and python_version of a file
+func packageType(filename string) (string, string) {
+	switch {
+	case strings.HasSuffix(filename, ".whl"):
+		// <name>-<version>(-<build>)?-<python>-<abi>-<platform>.whl
+		var parts = strings.Split(strings.TrimSuffix(filename, ".whl"), "-")
+		if len(parts) >= 5 {
+			return "bdist_wheel", parts[len(parts)-3]
+		}
+		return "bdist_wheel", ""
+	case strings.HasSuffix(filename, ".egg"):
+		return "bdist_egg", ""
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".zip"), strings.HasSuffix(filename, ".tar.bz2"):
+		return "sdist", "source"
+	}
+	return "", ""
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (r *Router) pypiFile(base string, a Asset, rel Release) pypiFile {
+	var packagetype, pythonVersion = packageType(a.Name)
+	var f = pypiFile{
+		Digests:       make(map[string]string),
+		Downloads:     -1,
+		Filename:      a.Name,
+		PackageType:   packagetype,
+		PythonVersion: pythonVersion,
+		Size:          a.Size,
+		URL:           base + r.assetLink(a),
+		Yanked:        a.Yanked,
+		YankedReason:  optionalString(a.YankedReason),
+	}
+	if a.SHA256 != "" {
+		f.Digests["sha256"] = a.SHA256
+	}
+	if a.Metadata != nil {
+		f.RequiresPython = optionalString(a.Metadata.RequiresPython)
+	}
+
+	var uploaded = rel.Published
+	if uploaded.IsZero() {
+		uploaded = a.Uploaded
+	}
+	if !uploaded.IsZero() {
+		uploaded = uploaded.UTC()
+		f.UploadTime = optionalString(uploaded.Format("2006-01-02T15:04:05"))
+		f.UploadTimeISO8601 = optionalString(uploaded.Format(time.RFC3339Nano))
+	}
+	return f
+}
+
+func (r *Router) pypiInfo(base string, project string, a Asset, rel Release, md *Metadata) pypiInfo {
+	var github = fmt.Sprintf("https://github.com/%s/%s", a.Owner, a.Repo)
+	var page = base + r.projectPageLink(a.Owner, a.Repo, project)
+	var info = pypiInfo{
+		Classifiers: make([]string, 0),
+		HomePage:    github,
+		Name:        project,
+		PackageURL:  page,
+		ProjectURL:  page,
+		ProjectURLs: map[string]string{
+			"Homepage": github,
+			"Source":   github,
+		},
+		ReleaseURL:   page + "#" + rel.Version,
+		Version:      rel.Version,
+		Yanked:       rel.Yanked,
+		YankedReason: optionalString(rel.YankedReason),
+	}
+	if md == nil {
+		return info
+	}
+
+	info.Name = md.Name
+	info.Summary = md.Summary
+	info.Description = md.Description
+	info.DescriptionContentType = optionalString(md.DescriptionContentType)
+	info.Keywords = md.Keywords
+	info.Author = md.Author
+	info.AuthorEmail = md.AuthorEmail
+	info.Maintainer = md.Maintainer
+	info.MaintainerEmail = md.MaintainerEmail
+	info.License = md.License
+	info.RequiresDist = md.RequiresDist
+	info.RequiresPython = optionalString(md.RequiresPython)
+	if md.Classifiers != nil {
+		info.Classifiers = md.Classifiers
+	}
+	if md.HomePage != "" {
+		info.HomePage = md.HomePage
+		info.ProjectURLs["Homepage"] = md.HomePage
+	}
+	for _, u := range md.ProjectURLs {
+		info.ProjectURLs[u.Label] = u.URL
+	}
+	return info
+}
+
+// pypiProject builds the PyPI JSON API response for project from the assets
+// the client making req can see, limited to a single version when version
+// isn't empty
+func (r *Router) pypiProject(req *http.Request, project string, version string) (pypiProject, bool) {
+	var resp pypiProject
+	var assets = filterAssets(r.visibleAssets(req), func(a Asset) bool {
+		return projectName(a) == project
+	})
+
+	// Files are keyed by the repo and version of their release, as the
+	// project may be published from more than one repo
+	var repos = make(map[string]Asset)
+	var files = make(map[string][]Asset)
+	for _, a := range assets {
+		repos[repoOf(a.Owner, a.Repo)] = a
+		var key = repoOf(a.Owner, a.Repo) + "@" + a.Version
+		files[key] = append(files[key], a)
+	}
+	var releaseFiles = func(rel Release) []Asset {
+		return files[repoOf(rel.Owner, rel.Repo)+"@"+rel.Version]
+	}
+
+	var releases = make([]Release, 0)
+	for _, rel := range r.syncer.Releases() {
+		if releaseProjectName(rel) == project && len(releaseFiles(rel)) > 0 {
+			releases = append(releases, rel)
+		}
+	}
+
+	var current, ok = latestRelease(releases)
+	if version != "" {
+		// Release versions are normalized, so e.g. 1.0.0-rc.1 finds 1.0.0rc1
+		if v, err := pep440.Normalize(version); err == nil {
+			version = v
+		}
+		ok = false
+		for _, rel := range releases {
+			if rel.Version == version {
+				current, ok = rel, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return resp, false
+	}
+
+	var base = r.baseURL(req)
+	resp.Info = r.pypiInfo(base, project, repos[repoOf(current.Owner, current.Repo)], current, releaseMetadata(releaseFiles(current)))
+	resp.URLs = make([]pypiFile, 0)
+	for _, rel := range releases {
+		if rel.Version != current.Version {
+			continue
+		}
+		for _, a := range releaseFiles(rel) {
+			resp.URLs = append(resp.URLs, r.pypiFile(base, a, rel))
+		}
+	}
+	resp.Vulnerabilities = make([]interface{}, 0)
+
+	if version == "" {
+		resp.Releases = make(map[string][]pypiFile)
+		for _, rel := range releases {
+			// The same version may be released from more than one repo
+			var list = resp.Releases[rel.Version]
+			if list == nil {
+				list = make([]pypiFile, 0)
+			}
+			for _, a := range releaseFiles(rel) {
+				list = append(list, r.pypiFile(base, a, rel))
+			}
+			resp.Releases[rel.Version] = list
+		}
+	}
+	return resp, true
+}
+
+func (r *Router) handlePyPIProject(w http.ResponseWriter, req *http.Request) {
+	var vars = mux.Vars(req)
+	var resp, ok = r.pypiProject(req, normalizeProjectName(vars["project"]), vars["version"])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,132 @@
+package pypihub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// LogFormatLogfmt writes log records as 'key=value' pairs
+	LogFormatLogfmt = "logfmt"
+	// LogFormatJSON writes log records as JSON objects, one per line
+	LogFormatJSON = "json"
+)
+
+// maxRequestIDLength is the longest incoming X-Request-ID we accept, longer
+// or otherwise suspicious ones are replaced with a generated ID
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request ctx belongs to, if any
+func RequestID(ctx context.Context) string {
+	var id, _ = ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("unknown log level %q, expected 'debug', 'info', 'warn' or 'error'", level)
+	}
+	return l, nil
+}
+
+// contextHandler adds the request ID and trace of the context being logged with to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging makes the default logger, which the standard log package also
+// writes through, log in the configured format and level
+func setupLogging(config Config) {
+	var opts = &slog.HandlerOptions{Level: config.logLevel}
+	var h slog.Handler
+	if config.LogFormat == LogFormatJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var raw = make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// requestID gives every request an ID, taken from its X-Request-ID header or
+// generated, which is echoed in the response and added to its log records
+func (r *Router) requestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var id = strings.TrimSpace(req.Header.Get("X-Request-ID"))
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// logRequests writes an access log record for every request
+func (r *Router) logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var start = time.Now()
+		var cw = &countingWriter{ResponseWriter: w}
+		h.ServeHTTP(cw, req)
+
+		slog.InfoContext(req.Context(), "request",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", cw.Status(),
+			"bytes", cw.bytes,
+			"duration", time.Since(start).Seconds(),
+			"user_agent", req.UserAgent(),
+			"remote_addr", req.RemoteAddr,
+			"client_ip", r.clientIP(req),
+		)
+	})
+}
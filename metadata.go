@@ -0,0 +1,642 @@
+package pypihub
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// metadataMaxFileSize is the largest metadata, pyproject.toml, setup.cfg
+	// or README file read from a distribution
+	metadataMaxFileSize = 4 << 20
+	// metadataMaxReferencedSize is the most of the other top level files of a
+	// distribution kept in case pyproject.toml or setup.cfg refers to them
+	metadataMaxReferencedSize = 16 << 20
+)
+
+// ProjectURL is a labelled URL of a project, e.g. its documentation
+type ProjectURL struct {
+	Label string
+	URL   string
+}
+
+// Metadata is the core metadata of a distribution, see
+// https://packaging.python.org/en/latest/specifications/core-metadata/
+type Metadata struct {
+	MetadataVersion        string
+	Name                   string
+	Version                string
+	Summary                string
+	Description            string
+	DescriptionContentType string
+	Keywords               string
+	HomePage               string
+	Author                 string
+	AuthorEmail            string
+	Maintainer             string
+	MaintainerEmail        string
+	License                string
+	Classifiers            []string
+	RequiresPython         string
+	RequiresDist           []string
+	ProjectURLs            []ProjectURL
+
+	// Source is the file the metadata was read from, one of 'METADATA'
+	// 'PKG-INFO' 'pyproject.toml' or 'setup.cfg'
+	Source string
+	// Raw is the METADATA or PKG-INFO file as found in the distribution,
+	// and RawSHA256 its hex encoded sha256 hash
+	Raw       []byte
+	RawSHA256 string
+}
+
+func (md *Metadata) set(key string, value string) {
+	switch key {
+	case "metadata-version":
+		md.MetadataVersion = value
+	case "name":
+		md.Name = value
+	case "version":
+		md.Version = value
+	case "summary":
+		md.Summary = value
+	case "description":
+		md.Description = value
+	case "description-content-type":
+		md.DescriptionContentType = value
+	case "keywords":
+		md.Keywords = value
+	case "home-page":
+		md.HomePage = value
+	case "author":
+		md.Author = value
+	case "author-email":
+		md.AuthorEmail = value
+	case "maintainer":
+		md.Maintainer = value
+	case "maintainer-email":
+		md.MaintainerEmail = value
+	case "license":
+		if md.License == "" {
+			md.License = value
+		}
+	case "license-expression":
+		md.License = value
+	case "classifier":
+		md.Classifiers = append(md.Classifiers, value)
+	case "requires-python":
+		md.RequiresPython = value
+	case "requires-dist":
+		md.RequiresDist = append(md.RequiresDist, value)
+	case "project-url":
+		var p = strings.SplitN(value, ",", 2)
+		if len(p) == 2 {
+			md.ProjectURLs = append(md.ProjectURLs, ProjectURL{Label: strings.TrimSpace(p[0]), URL: strings.TrimSpace(p[1])})
+		}
+	}
+}
+
+// unfoldDescription removes the indentation, and '|' prefix, older tools put
+// in front of every continuation line of a Description header
+func unfoldDescription(value string) string {
+	var lines = strings.Split(value, "\n")
+	for i := 1; i < len(lines); i++ {
+		var line = lines[i]
+		var trimmed = strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "|") {
+			lines[i] = trimmed[1:]
+		} else if len(line)-len(trimmed) >= 8 {
+			lines[i] = line[8:]
+		} else {
+			lines[i] = trimmed
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseCoreMetadata parses a METADATA or PKG-INFO file, which is made of
+// email style headers optionally followed by the description as the body
+func parseCoreMetadata(data []byte, source string) (*Metadata, error) {
+	var sum = sha256.Sum256(data)
+	var md = &Metadata{Source: source, Raw: data, RawSHA256: hex.EncodeToString(sum[:])}
+	var lines = strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+
+	var key, value string
+	var flush = func() {
+		if key == "description" {
+			value = unfoldDescription(value)
+		}
+		if key != "" {
+			md.set(key, value)
+		}
+		key = ""
+	}
+
+	var i int
+	for i = 0; i < len(lines); i++ {
+		var line = lines[i]
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if key != "" {
+				value += "\n" + line
+			}
+			continue
+		}
+
+		flush()
+		var p = strings.SplitN(line, ":", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("%s: invalid header %q", source, line)
+		}
+		key = strings.ToLower(strings.TrimSpace(p[0]))
+		value = strings.TrimSpace(p[1])
+	}
+	flush()
+
+	if i < len(lines) {
+		if body := strings.TrimSpace(strings.Join(lines[i+1:], "\n")); body != "" {
+			md.Description = body
+		}
+	}
+	if md.Name == "" {
+		return nil, fmt.Errorf("%s: no Name", source)
+	}
+	return md, nil
+}
+
+// extraMarker finds the extra a requirement is for, e.g. 'extra == "fast"'
+var extraMarker = regexp.MustCompile(`extra == "([^"]+)"`)
+
+// formatCoreMetadata writes md as a PKG-INFO file, see parseCoreMetadata
+func formatCoreMetadata(md *Metadata) []byte {
+	var b bytes.Buffer
+	var header = func(key string, value string) {
+		if value != "" {
+			// Continuation lines are indented
+			fmt.Fprintf(&b, "%s: %s\n", key, strings.Replace(strings.TrimSpace(value), "\n", "\n        ", -1))
+		}
+	}
+
+	header("Metadata-Version", "2.1")
+	header("Name", md.Name)
+	header("Version", md.Version)
+	header("Summary", md.Summary)
+	header("Keywords", md.Keywords)
+	header("Home-page", md.HomePage)
+	header("Author", md.Author)
+	header("Author-email", md.AuthorEmail)
+	header("Maintainer", md.Maintainer)
+	header("Maintainer-email", md.MaintainerEmail)
+	header("License", md.License)
+	for _, c := range md.Classifiers {
+		header("Classifier", c)
+	}
+	header("Requires-Python", md.RequiresPython)
+	var extras = make([]string, 0)
+	for _, req := range md.RequiresDist {
+		header("Requires-Dist", req)
+		if m := extraMarker.FindStringSubmatch(req); m != nil {
+			extras = append(extras, m[1])
+		}
+	}
+	extras = uniqueSlice(extras)
+	sort.Strings(extras)
+	for _, extra := range extras {
+		header("Provides-Extra", extra)
+	}
+	for _, u := range md.ProjectURLs {
+		header("Project-URL", u.Label+", "+u.URL)
+	}
+	if md.Description != "" {
+		header("Description-Content-Type", md.DescriptionContentType)
+		b.WriteString("\n")
+		b.WriteString(md.Description)
+		if !strings.HasSuffix(md.Description, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes()
+}
+
+func readAll(r io.Reader, name string) ([]byte, error) {
+	var data, err = ioutil.ReadAll(io.LimitReader(r, metadataMaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > metadataMaxFileSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, metadataMaxFileSize)
+	}
+	return data, nil
+}
+
+// readWheelMetadata reads the METADATA file of a wheel, only reading the parts
+// of the archive it needs. It returns nil when the wheel has no METADATA.
+func readWheelMetadata(r io.ReaderAt, size int64) (*Metadata, error) {
+	var zr, err = zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		var dir, name = path.Split(f.Name)
+		if name != "METADATA" || !strings.HasSuffix(dir, ".dist-info/") || strings.Count(dir, "/") != 1 {
+			continue
+		}
+
+		var rc io.ReadCloser
+		rc, err = f.Open()
+		if err != nil {
+			return nil, err
+		}
+		var data []byte
+		data, err = readAll(rc, f.Name)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		return parseCoreMetadata(data, "METADATA")
+	}
+	return nil, nil
+}
+
+// coreMetadata returns the METADATA file of the wheel a, which is served next
+// to it as '<wheel>.metadata' (PEP 658), and its hex encoded sha256 hash
+func coreMetadata(a Asset) ([]byte, string, bool) {
+	if !strings.HasSuffix(a.Name, ".whl") || a.Metadata == nil || a.Metadata.Source != "METADATA" {
+		return nil, "", false
+	}
+	return a.Metadata.Raw, a.Metadata.RawSHA256, true
+}
+
+// readSdistMetadata reads the PKG-INFO file of a gzipped tar sdist, falling
+// back to the static metadata in pyproject.toml or setup.cfg for archives
+// without one, e.g. GitHub tag archives. It returns nil when it finds neither.
+func readSdistMetadata(r io.Reader) (*Metadata, error) {
+	var gz, err = gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	// Top level files we may need to fall back to, and their size besides the metadata files
+	var files = make(map[string][]byte)
+	var kept int64
+	var tr = tar.NewReader(gz)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		// Only look at files directly inside the archive's root directory
+		var parts = strings.Split(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		var name = parts[1]
+		if !isMetadataFile(name) {
+			if keepReferencedFile(hdr.Size, kept) {
+				if files[name], err = readAll(tr, hdr.Name); err != nil {
+					return nil, err
+				}
+				kept += hdr.Size
+			}
+			continue
+		}
+
+		var data []byte
+		data, err = readAll(tr, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "PKG-INFO" {
+			return parseCoreMetadata(data, "PKG-INFO")
+		}
+		files[name] = data
+	}
+	return staticMetadata(files)
+}
+
+// isMetadataFile reports whether name is a top level file of an sdist we read metadata from
+func isMetadataFile(name string) bool {
+	return name == "PKG-INFO" || name == "pyproject.toml" || name == "setup.cfg"
+}
+
+// keepReferencedFile reports whether another top level file of an sdist, of
+// size bytes, is kept given the size of the ones kept so far, as pyproject.toml
+// or setup.cfg may refer to any of them, e.g. with 'readme', 'license = {file = ...}' or 'file:'
+func keepReferencedFile(size int64, kept int64) bool {
+	return size <= metadataMaxFileSize && kept+size <= metadataMaxReferencedSize
+}
+
+// staticMetadata builds metadata from the pyproject.toml or setup.cfg in the
+// top level files of an sdist, nil when neither has any
+func staticMetadata(files map[string][]byte) (*Metadata, error) {
+	if data, ok := files["pyproject.toml"]; ok {
+		var md, err = pyprojectMetadata(data, files)
+		if md != nil || err != nil {
+			return md, err
+		}
+	}
+	if data, ok := files["setup.cfg"]; ok {
+		return setupCfgMetadata(data, files)
+	}
+	return nil, nil
+}
+
+// readmeContentType guesses the content type of a README from its file name
+func readmeContentType(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		return "text/markdown"
+	case ".rst":
+		return "text/x-rst"
+	default:
+		return "text/plain"
+	}
+}
+
+// withExtra adds an 'extra == "<extra>"' marker to the requirement req
+func withExtra(req string, extra string) string {
+	var p = strings.SplitN(req, ";", 2)
+	if len(p) == 2 && strings.TrimSpace(p[1]) != "" {
+		return fmt.Sprintf("%s; (%s) and extra == \"%s\"", strings.TrimSpace(p[0]), strings.TrimSpace(p[1]), extra)
+	}
+	return fmt.Sprintf("%s; extra == \"%s\"", strings.TrimSpace(p[0]), extra)
+}
+
+func tomlString(v interface{}) string {
+	var s, _ = v.(string)
+	return s
+}
+
+func tomlStrings(v interface{}) []string {
+	var list, _ = v.([]interface{})
+	var strs = make([]string, 0, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// tomlPeople returns the names and emails of a pyproject.toml authors or maintainers list
+func tomlPeople(v interface{}) (string, string) {
+	var list, _ = v.([]interface{})
+	var names, emails []string
+	for _, item := range list {
+		var person, _ = item.(map[string]interface{})
+		var name, email = tomlString(person["name"]), tomlString(person["email"])
+		switch {
+		case email != "" && name != "":
+			emails = append(emails, fmt.Sprintf("%s <%s>", name, email))
+		case email != "":
+			emails = append(emails, email)
+		case name != "":
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", "), strings.Join(emails, ", ")
+}
+
+// pyprojectMetadata builds metadata from the [project] table of a
+// pyproject.toml, see https://packaging.python.org/en/latest/specifications/pyproject-toml/.
+// Fields listed as dynamic are left empty. It returns nil when there is no [project] table.
+func pyprojectMetadata(data []byte, files map[string][]byte) (*Metadata, error) {
+	var doc, err = parseTOML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("pyproject.toml: %s", err)
+	}
+	var project, _ = doc["project"].(map[string]interface{})
+	if tomlString(project["name"]) == "" {
+		return nil, nil
+	}
+
+	var md = &Metadata{
+		Source:         "pyproject.toml",
+		Name:           tomlString(project["name"]),
+		Version:        tomlString(project["version"]),
+		Summary:        tomlString(project["description"]),
+		RequiresPython: tomlString(project["requires-python"]),
+		RequiresDist:   tomlStrings(project["dependencies"]),
+		Keywords:       strings.Join(tomlStrings(project["keywords"]), ","),
+		Classifiers:    tomlStrings(project["classifiers"]),
+	}
+	md.Author, md.AuthorEmail = tomlPeople(project["authors"])
+	md.Maintainer, md.MaintainerEmail = tomlPeople(project["maintainers"])
+
+	var extras, _ = project["optional-dependencies"].(map[string]interface{})
+	for _, extra := range sortedMapKeys(extras) {
+		for _, req := range tomlStrings(extras[extra]) {
+			md.RequiresDist = append(md.RequiresDist, withExtra(req, extra))
+		}
+	}
+
+	switch license := project["license"].(type) {
+	case string:
+		md.License = license
+	case map[string]interface{}:
+		md.License = tomlString(license["text"])
+		if f := tomlString(license["file"]); f != "" && md.License == "" {
+			md.License = string(files[f])
+		}
+	}
+
+	var urls, _ = project["urls"].(map[string]interface{})
+	for _, label := range sortedMapKeys(urls) {
+		md.ProjectURLs = append(md.ProjectURLs, ProjectURL{Label: label, URL: tomlString(urls[label])})
+	}
+
+	switch readme := project["readme"].(type) {
+	case string:
+		md.Description = string(files[readme])
+		md.DescriptionContentType = readmeContentType(readme)
+	case map[string]interface{}:
+		md.DescriptionContentType = tomlString(readme["content-type"])
+		if text := tomlString(readme["text"]); text != "" {
+			md.Description = text
+		} else {
+			md.Description = string(files[tomlString(readme["file"])])
+		}
+	}
+	if md.Description == "" {
+		md.DescriptionContentType = ""
+	}
+	return md, nil
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseSetupCfg parses the INI format of setup.cfg into sections of keys,
+// with multi-line values joined by newlines
+func parseSetupCfg(data string) map[string]map[string]string {
+	var sections = make(map[string]map[string]string)
+	var section map[string]string
+	var key string
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		var trimmed = strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if section != nil && key != "" {
+				section[key] = strings.TrimSpace(section[key] + "\n" + trimmed)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			var name = strings.ToLower(strings.TrimSpace(trimmed[1 : len(trimmed)-1]))
+			if sections[name] == nil {
+				sections[name] = make(map[string]string)
+			}
+			section = sections[name]
+			key = ""
+			continue
+		}
+
+		var i = strings.IndexAny(trimmed, "=:")
+		if section == nil || i < 0 {
+			continue
+		}
+		key = strings.Replace(strings.ToLower(strings.TrimSpace(trimmed[:i])), "-", "_", -1)
+		section[key] = strings.TrimSpace(trimmed[i+1:])
+	}
+	return sections
+}
+
+// setupCfgList splits a setup.cfg list value, given either one per line or
+// on one line separated by sep
+func setupCfgList(value string, sep string) []string {
+	var items []string
+	if strings.Contains(value, "\n") {
+		items = strings.Split(value, "\n")
+	} else {
+		items = strings.Split(value, sep)
+	}
+	var list = make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// setupCfgMetadata builds metadata from the [metadata] and [options] sections
+// of a setup.cfg, values read with 'attr:' are left empty. It returns nil
+// when there is no name in the [metadata] section.
+func setupCfgMetadata(data []byte, files map[string][]byte) (*Metadata, error) {
+	var cfg = parseSetupCfg(string(data))
+	var meta, options = cfg["metadata"], cfg["options"]
+	if meta["name"] == "" {
+		return nil, nil
+	}
+
+	// Resolve 'file:' values from the files we have, dropping 'attr:' ones
+	var value = func(section map[string]string, key string) string {
+		var v = section[key]
+		switch {
+		case strings.HasPrefix(v, "attr:"):
+			return ""
+		case strings.HasPrefix(v, "file:"):
+			var parts []string
+			for _, f := range setupCfgList(strings.TrimPrefix(v, "file:"), ",") {
+				parts = append(parts, string(files[f]))
+			}
+			return strings.Join(parts, "\n")
+		}
+		return v
+	}
+
+	var md = &Metadata{
+		Source:                 "setup.cfg",
+		Name:                   meta["name"],
+		Version:                value(meta, "version"),
+		Summary:                value(meta, "description"),
+		Description:            value(meta, "long_description"),
+		DescriptionContentType: meta["long_description_content_type"],
+		Keywords:               strings.Join(setupCfgList(meta["keywords"], ","), ","),
+		HomePage:               meta["url"],
+		Author:                 meta["author"],
+		AuthorEmail:            meta["author_email"],
+		Maintainer:             meta["maintainer"],
+		MaintainerEmail:        meta["maintainer_email"],
+		License:                value(meta, "license"),
+		Classifiers:            setupCfgList(value(meta, "classifiers"), ","),
+		RequiresPython:         options["python_requires"],
+		RequiresDist:           setupCfgList(options["install_requires"], ";"),
+	}
+	if md.HomePage == "" {
+		md.HomePage = meta["home_page"]
+	}
+	if md.Description != "" && md.DescriptionContentType == "" {
+		if f := strings.TrimSpace(strings.TrimPrefix(meta["long_description"], "file:")); f != meta["long_description"] {
+			md.DescriptionContentType = readmeContentType(f)
+		}
+	}
+
+	for _, u := range setupCfgList(meta["project_urls"], ",") {
+		var p = strings.SplitN(u, "=", 2)
+		if len(p) == 2 {
+			md.ProjectURLs = append(md.ProjectURLs, ProjectURL{Label: strings.TrimSpace(p[0]), URL: strings.TrimSpace(p[1])})
+		}
+	}
+
+	var extras = cfg["options.extras_require"]
+	var names = make([]string, 0, len(extras))
+	for extra := range extras {
+		names = append(names, extra)
+	}
+	sort.Strings(names)
+	for _, extra := range names {
+		for _, req := range setupCfgList(extras[extra], ";") {
+			md.RequiresDist = append(md.RequiresDist, withExtra(req, extra))
+		}
+	}
+	return md, nil
+}
+
+// metadataSources ranks where metadata was read from, best first
+var metadataSources = []string{"METADATA", "PKG-INFO", "pyproject.toml", "setup.cfg"}
+
+// releaseMetadata returns the best metadata of the files of a release, i.e.
+// the metadata built by packaging tools over what we read from their sources
+func releaseMetadata(assets []Asset) *Metadata {
+	for _, source := range metadataSources {
+		for _, a := range assets {
+			if a.Metadata != nil && a.Metadata.Source == source {
+				return a.Metadata
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package pypihub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// metadataConcurrency is how many assets metadata is extracted from at once
+	metadataConcurrency = 4
+	// metadataRetryInterval is how long to wait before retrying an asset whose metadata couldn't be read
+	metadataRetryInterval = time.Hour
+	// metadataMaxArchiveSize is the most of an sdist or tag archive read while looking for its metadata
+	metadataMaxArchiveSize = 256 << 20
+)
+
+type metadataEntry struct {
+	md      *Metadata
+	err     error
+	checked time.Time
+}
+
+// metadataStore extracts the metadata of assets, remembering it for as long as
+// the assets exist so every asset is only read once
+type metadataStore struct {
+	client *Client
+
+	mu sync.Mutex
+	// repos maps a repo key to the entries of its assets by metadataKey
+	repos map[string]map[string]*metadataEntry
+}
+
+func newMetadataStore(client *Client) *metadataStore {
+	return &metadataStore{
+		client: client,
+		repos:  make(map[string]map[string]*metadataEntry),
+	}
+}
+
+// metadataKey identifies the contents of an asset, release assets get a new ID
+// whenever they are replaced
+func metadataKey(a Asset) string {
+	if a.Ref != "" {
+		return fmt.Sprintf("%s:%s:%s", a.Format, a.Ref, a.Subdir)
+	}
+	return fmt.Sprintf("%d:%d", a.ID, a.Uploaded.Unix())
+}
+
+// hasMetadata reports whether we know how to read metadata from the asset a
+func hasMetadata(a Asset) bool {
+	return strings.HasSuffix(a.Name, ".whl") || strings.HasSuffix(a.Name, ".tar.gz")
+}
+
+// errArchiveTooLarge is returned instead of reading past metadataMaxArchiveSize
+var errArchiveTooLarge = fmt.Errorf("archive is larger than %d bytes", metadataMaxArchiveSize)
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errArchiveTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	var n, err = l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (m *metadataStore) extract(ctx context.Context, a Asset) (*Metadata, error) {
+	var ctx2, span = startSpan(ctx, "metadata extract", trace.SpanKindInternal, attribute.String("asset", a.URL()))
+	defer span.End()
+
+	var md *Metadata
+	var err error
+	if strings.HasSuffix(a.Name, ".whl") {
+		var r *rangeReader
+		r, err = newRangeReader(ctx2, m.client, a)
+		if err == nil {
+			md, err = readWheelMetadata(r, r.Size())
+		}
+	} else {
+		var body io.ReadCloser
+		body, err = a.Download(ctx2, m.client)
+		if err == nil {
+			md, err = readSdistMetadata(&limitedReader{r: body, n: metadataMaxArchiveSize})
+			if a.rewritten() {
+				// Rewritten archives are only cached, and their hash known, once read to the end
+				io.Copy(io.Discard, body)
+			}
+			body.Close()
+		}
+	}
+	recordError(span, err)
+	if md != nil {
+		span.SetAttributes(attribute.String("metadata.source", md.Source))
+	}
+	return md, err
+}
+
+// known sets the metadata of the assets of the repo key which it has been read
+// from already, and forgets about assets no longer in assets. It reports
+// whether fill has any assets left to read.
+func (m *metadataStore) known(key string, assets []Asset) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries = make(map[string]*metadataEntry)
+	var missing = false
+	for i := range assets {
+		if !hasMetadata(assets[i]) {
+			continue
+		}
+		var k = metadataKey(assets[i])
+		var e, ok = m.repos[key][k]
+		if !ok || (e.err != nil && time.Since(e.checked) >= metadataRetryInterval) {
+			missing = true
+		}
+		if ok {
+			entries[k] = e
+			assets[i].Metadata = e.md
+		}
+	}
+	m.repos[key] = entries
+	return missing
+}
+
+// fill sets the metadata of the assets of the repo key, extracting it from any
+// assets it hasn't been read from yet, and forgets about assets no longer in assets
+func (m *metadataStore) fill(ctx context.Context, key string, assets []Asset) {
+	m.mu.Lock()
+	var previous = m.repos[key]
+	m.mu.Unlock()
+
+	var entries = make(map[string]*metadataEntry)
+	var wg sync.WaitGroup
+	var sem = make(chan struct{}, metadataConcurrency)
+	var mu sync.Mutex
+	for i := range assets {
+		if !hasMetadata(assets[i]) {
+			continue
+		}
+
+		var k = metadataKey(assets[i])
+		if e, ok := previous[k]; ok && (e.err == nil || time.Since(e.checked) < metadataRetryInterval) {
+			// Extractions started for earlier assets may be writing entries already
+			mu.Lock()
+			entries[k] = e
+			mu.Unlock()
+			assets[i].Metadata = e.md
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, k string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var md, err = m.extract(ctx, assets[i])
+			if err != nil {
+				slog.Warn("error reading package metadata", "asset", assets[i].URL(), "error", err)
+			}
+			assets[i].Metadata = md
+
+			mu.Lock()
+			entries[k] = &metadataEntry{md: md, err: err, checked: time.Now()}
+			mu.Unlock()
+		}(i, k)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	m.repos[key] = entries
+	m.mu.Unlock()
+}
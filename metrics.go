@@ -0,0 +1,213 @@
+package pypihub
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the latency histograms
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics are the metrics about requests served by the router
+type metrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+	bytes     *prometheus.CounterVec
+	cache     *prometheus.CounterVec
+	inFlight  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	var m = &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pypihub_http_requests_total",
+			Help: "Number of HTTP requests served.",
+		}, []string{"route", "method", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pypihub_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests served.",
+			Buckets: durationBuckets,
+		}, []string{"route", "method"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pypihub_http_response_bytes_total",
+			Help: "Number of response body bytes sent.",
+		}, []string{"route"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pypihub_download_cache_total",
+			Help: "Number of downloads in redirect mode by whether their redirect URL was cached.",
+		}, []string{"result"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pypihub_downloads_in_flight",
+			Help: "Number of downloads currently being served.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+		m.requests,
+		m.durations,
+		m.bytes,
+		m.cache,
+		m.inFlight,
+	)
+	return m
+}
+
+// upstreamMetrics are the metrics about calls made to the GitHub API
+type upstreamMetrics struct {
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+func newUpstreamMetrics() *upstreamMetrics {
+	return &upstreamMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pypihub_github_requests_total",
+			Help: "Number of GitHub API calls.",
+		}, []string{"endpoint", "method", "status"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "pypihub_github_request_duration_seconds",
+			Help:    "Latency of GitHub API calls.",
+			Buckets: durationBuckets,
+		}, []string{"endpoint", "method"}),
+	}
+}
+
+var (
+	rateLimitDesc          = prometheus.NewDesc("pypihub_github_rate_limit", "GitHub API rate limit.", nil, nil)
+	rateLimitRemainingDesc = prometheus.NewDesc("pypihub_github_rate_limit_remaining", "Remaining GitHub API rate limit.", nil, nil)
+	repoAssetsDesc         = prometheus.NewDesc("pypihub_repo_assets", "Number of assets found for each repo.", []string{"repo"}, nil)
+	repoSyncsDesc          = prometheus.NewDesc("pypihub_repo_syncs_total", "Number of syncs of each repo by result.", []string{"repo", "result"}, nil)
+	repoSyncDurationDesc   = prometheus.NewDesc("pypihub_repo_sync_duration_seconds", "Duration of the last sync of each repo.", []string{"repo"}, nil)
+	repoSyncSuccessDesc    = prometheus.NewDesc("pypihub_repo_sync_success", "Whether the last sync of each repo succeeded.", []string{"repo"}, nil)
+	repoLastSuccessDesc    = prometheus.NewDesc("pypihub_repo_last_success_timestamp_seconds", "When each repo was last synced successfully.", []string{"repo"}, nil)
+)
+
+// statusCollector collects the GitHub rate limit and the sync status of each
+// repo when scraped
+type statusCollector struct {
+	client *Client
+	syncer *syncer
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitDesc
+	ch <- rateLimitRemainingDesc
+	ch <- repoAssetsDesc
+	ch <- repoSyncsDesc
+	ch <- repoSyncDurationDesc
+	ch <- repoSyncSuccessDesc
+	ch <- repoLastSuccessDesc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	if rate := c.client.RateLimit(); rate.Limit > 0 {
+		ch <- prometheus.MustNewConstMetric(rateLimitDesc, prometheus.GaugeValue, float64(rate.Limit))
+		ch <- prometheus.MustNewConstMetric(rateLimitRemainingDesc, prometheus.GaugeValue, float64(rate.Remaining))
+	}
+
+	for _, s := range c.syncer.Status() {
+		ch <- prometheus.MustNewConstMetric(repoAssetsDesc, prometheus.GaugeValue, float64(s.Assets), s.Repo)
+		ch <- prometheus.MustNewConstMetric(repoSyncsDesc, prometheus.CounterValue, float64(s.Syncs-s.Failures), s.Repo, "success")
+		ch <- prometheus.MustNewConstMetric(repoSyncsDesc, prometheus.CounterValue, float64(s.Failures), s.Repo, "error")
+		if s.LastSync == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(repoSyncDurationDesc, prometheus.GaugeValue, s.Duration, s.Repo)
+		var healthy float64 = 1
+		if s.LastError != "" {
+			healthy = 0
+		}
+		ch <- prometheus.MustNewConstMetric(repoSyncSuccessDesc, prometheus.GaugeValue, healthy, s.Repo)
+		if s.LastSuccess != nil {
+			ch <- prometheus.MustNewConstMetric(repoLastSuccessDesc, prometheus.GaugeValue, float64(s.LastSuccess.Unix()), s.Repo)
+		}
+	}
+}
+
+// githubEndpoint turns a GitHub API path into a low cardinality endpoint name
+// e.g. '/repos/{owner}/{repo}/releases/{id}/assets'
+func githubEndpoint(p string) string {
+	var parts = strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) >= 3 && parts[0] == "repos" {
+		parts[1] = "{owner}"
+		parts[2] = "{repo}"
+	}
+	for i, part := range parts {
+		if (part == "tarball" || part == "zipball") && i+1 < len(parts) {
+			// Refs may contain slashes
+			parts = append(parts[:i+1], "{ref}")
+			break
+		}
+		if _, err := strconv.ParseInt(part, 10, 64); err == nil {
+			parts[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// instrumentedTransport records the count and latency of every GitHub API
+// call, and traces it with a client span
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	metrics *upstreamMetrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var start = time.Now()
+	var endpoint = githubEndpoint(req.URL.Path)
+	var ctx, span = startSpan(req.Context(), req.Method+" "+endpoint, trace.SpanKindClient,
+		semconv.HTTPRequestMethodKey.String(req.Method),
+		semconv.ServerAddress(req.URL.Host),
+		semconv.URLPath(req.URL.Path),
+	)
+	defer span.End()
+
+	var resp, err = t.next.RoundTrip(req.WithContext(ctx))
+	recordError(span, err)
+
+	var status = "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
+	t.metrics.requests.WithLabelValues(endpoint, req.Method, status).Inc()
+	t.metrics.durations.WithLabelValues(endpoint, req.Method).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// instrument records the count, latency and size of every response, labelled
+// by the path template of the route in routes which served it
+func (r *Router) instrument(routes *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var start = time.Now()
+		var cw = &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req)
+
+		var route = "unmatched"
+		var match mux.RouteMatch
+		if routes.Match(req, &match) {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		r.metrics.requests.WithLabelValues(route, req.Method, strconv.Itoa(cw.Status())).Inc()
+		r.metrics.durations.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		r.metrics.bytes.WithLabelValues(route).Add(float64(cw.bytes))
+	})
+}
+
+func (r *Router) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	promhttp.HandlerFor(r.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
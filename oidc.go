@@ -0,0 +1,408 @@
+package pypihub
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcLeeway is the clock skew allowed when checking token times
+	oidcLeeway = time.Minute
+	// jwksRefreshInterval is how often keys are refetched, and the minimum
+	// time between refetches when a token uses a key we don't know
+	jwksRefreshInterval = time.Hour
+	jwksMinRefetch      = time.Minute
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	var b, err = base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		var n, err = decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		var e *big.Int
+		e, err = decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		var x, err = decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		var y *big.Int
+		y, err = decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// oidcAuthenticator accepts JWT bearer tokens signed by a trusted issuer,
+// e.g. the OIDC identity tokens CI runners are given, granting access
+// according to rules matched against the token's claims
+type oidcAuthenticator struct {
+	issuer   string
+	audience string
+	jwks     string
+	rules    []grantRule
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastFetch   time.Time
+	lastAttempt time.Time
+	// fetching is closed once the running refetch of the keys, if any, is over
+	fetching chan struct{}
+}
+
+func newOIDCAuthenticator(config Config) (*oidcAuthenticator, error) {
+	var o = &oidcAuthenticator{
+		issuer:   strings.TrimSuffix(config.OIDCIssuer, "/"),
+		audience: config.OIDCAudience,
+		jwks:     config.OIDCJWKS,
+		client: &http.Client{
+			Transport: &propagatingTransport{next: http.DefaultTransport},
+			Timeout:   30 * time.Second,
+		},
+		keys: make(map[string]crypto.PublicKey),
+	}
+	for _, s := range config.OIDCRules {
+		var rule, err = parseGrantRule(s)
+		if err != nil {
+			return nil, err
+		}
+		o.rules = append(o.rules, rule)
+	}
+
+	if o.jwks == "" {
+		var err error
+		o.jwks, err = o.discoverJWKS(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("discovering JWKS for %s: %s", o.issuer, err)
+		}
+	}
+
+	var keys, err = o.fetchKeys(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("loading JWKS from %s: %s", o.jwks, err)
+	}
+	o.keys = keys
+	o.lastFetch = time.Now()
+	o.lastAttempt = o.lastFetch
+	return o, nil
+}
+
+func (o *oidcAuthenticator) getJSON(ctx context.Context, u string, v interface{}) error {
+	var req, err = http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	var resp *http.Response
+	resp, err = o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *oidcAuthenticator) discoverJWKS(ctx context.Context) (string, error) {
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(ctx, o.issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return "", err
+	}
+	if doc.JWKSURI == "" {
+		return "", fmt.Errorf("no jwks_uri in the OpenID configuration")
+	}
+	return doc.JWKSURI, nil
+}
+
+// fetchKeys loads the JWKS from a URL or local file
+func (o *oidcAuthenticator) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	var err error
+	if strings.HasPrefix(o.jwks, "http://") || strings.HasPrefix(o.jwks, "https://") {
+		err = o.getJSON(ctx, o.jwks, &set)
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(o.jwks)
+		if err == nil {
+			err = json.Unmarshal(data, &set)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key, err = k.publicKey()
+		if err != nil {
+			slog.Warn("ignoring JWKS key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// refetchKeys replaces the keys with freshly fetched ones, closing done when it is over
+func (o *oidcAuthenticator) refetchKeys(ctx context.Context, done chan struct{}) {
+	var keys, err = o.fetchKeys(ctx)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		slog.Error("error refetching JWKS", "jwks", o.jwks, "error", err)
+	} else {
+		o.keys = keys
+		o.lastFetch = time.Now()
+	}
+	o.fetching = nil
+	close(done)
+}
+
+// key returns the public key with the given id, refetching the keys when they
+// are stale or we don't know the id, e.g. because the issuer rotated them.
+// Only one refetch runs at a time, and it doesn't hold up tokens signed with
+// keys we already know.
+func (o *oidcAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, bool) {
+	o.mu.Lock()
+	var key, ok = o.keys[kid]
+	var stale = time.Since(o.lastFetch) > jwksRefreshInterval
+	var done = o.fetching
+	if done == nil && (!ok || stale) && time.Since(o.lastAttempt) > jwksMinRefetch {
+		o.lastAttempt = time.Now()
+		done = make(chan struct{})
+		o.fetching = done
+		// Other requests may wait for the refetch, so it outlives this one
+		go o.refetchKeys(context.WithoutCancel(ctx), done)
+	}
+	o.mu.Unlock()
+
+	if ok || done == nil {
+		return key, ok
+	}
+	// Wait for the keys the issuer may have rotated to
+	<-done
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key, ok = o.keys[kid]
+	return key, ok
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "512":
+		h, ch = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h.Write(signed)
+	var digest = h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		var pub, ok = key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s token signed with a non RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, ch, digest, sig)
+	case "PS":
+		var pub, ok = key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s token signed with a non RSA key", alg)
+		}
+		return rsa.VerifyPSS(pub, ch, digest, sig, nil)
+	case "ES":
+		var pub, ok = key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s token signed with a non EC key", alg)
+		}
+		var size = len(sig) / 2
+		if len(sig) == 0 || len(sig)%2 != 0 {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		var r = new(big.Int).SetBytes(sig[:size])
+		var s = new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	var v, ok = claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+func (o *oidcAuthenticator) audienceMatches(claims map[string]interface{}) bool {
+	if o.audience == "" {
+		return true
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == o.audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == o.audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks the token's signature, issuer, audience and validity period, returning its claims
+func (o *oidcAuthenticator) verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	var parts = strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var data, err = base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	if len(header.Alg) != 5 {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var key, ok = o.key(ctx, header.Kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+
+	var sig []byte
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	if err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims: %s", err)
+	}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %s", err)
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !o.audienceMatches(claims) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	var now = time.Now()
+	if exp, ok := claimTime(claims, "exp"); !ok || now.After(exp.Add(oidcLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Before(nbf.Add(-oidcLeeway)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	return claims, nil
+}
+
+func (o *oidcAuthenticator) Authenticate(req *http.Request) *Identity {
+	var token = bearerToken(req)
+	if strings.Count(token, ".") != 2 {
+		return nil
+	}
+
+	var claims, err = o.verify(req.Context(), token)
+	if err != nil {
+		slog.InfoContext(req.Context(), "rejecting OIDC token", "error", err)
+		return nil
+	}
+
+	return &Identity{
+		Name:   fmt.Sprint(claims["sub"]),
+		Method: "oidc",
+		Grants: grantsFor(o.rules, claims),
+	}
+}
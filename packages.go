@@ -0,0 +1,68 @@
+package pypihub
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// repoPackage is one of several Python packages living in subdirectories of a
+// single repo, each with its own project name and tags
+type repoPackage struct {
+	project string
+	// subdir is the directory of the package relative to the root of the repo
+	subdir string
+	rule   versionRule
+}
+
+// parsePackages parses a list of '<owner>/<repo>=<project>:<subdirectory>[:<tag pattern>]'
+// flag values, plus any space separated ones from $PYPIHUB_PACKAGES, into a
+// map of repo key to the packages of the repo
+func (c Config) parsePackages(values []string) (map[string][]repoPackage, error) {
+	if val, ok := os.LookupEnv("PYPIHUB_PACKAGES"); ok {
+		values = append(values, strings.Split(val, " ")...)
+	}
+
+	var packages = make(map[string][]repoPackage)
+	for _, v := range removeEmpty(values) {
+		var p = strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("%q, expected '<owner>/<repo>=<project>:<subdirectory>[:<tag pattern>]'", v)
+		}
+		var fields = strings.SplitN(p[1], ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%q, expected '<owner>/<repo>=<project>:<subdirectory>[:<tag pattern>]'", v)
+		}
+
+		var pkg = repoPackage{
+			project: fields[0],
+			subdir:  strings.Trim(path.Clean("/"+fields[1]), "/"),
+			rule:    versionRule{from: VersionFromTag},
+		}
+		// Tags are '<project>/<version>' unless told otherwise, e.g. 'auth-client/v1.2.0'
+		var pattern = "^" + regexp.QuoteMeta(pkg.project) + "/(?P<version>.+)$"
+		if len(fields) == 3 && fields[2] != "" {
+			pattern = fields[2]
+		}
+		var err error
+		if pkg.rule.pattern, err = parseTagPattern(pattern); err != nil {
+			return nil, fmt.Errorf("%q: %s", v, err)
+		}
+
+		var key = c.repoKey(p[0])
+		for _, existing := range packages[key] {
+			if strings.EqualFold(existing.project, pkg.project) {
+				return nil, fmt.Errorf("%q: %s is already defined for %s", v, pkg.project, p[0])
+			}
+		}
+		packages[key] = append(packages[key], pkg)
+	}
+	return packages, nil
+}
+
+// repoPackages returns the packages defined for the repo r, if any
+func (c Config) repoPackages(r string) []repoPackage {
+	return c.packages[c.repoKey(r)]
+}
@@ -0,0 +1,183 @@
+package pypihub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// assetLinker returns the href to use for an asset on a rendered page
+type assetLinker func(a Asset) string
+
+// projectLinker returns the href to use for a project on the simple index page
+type projectLinker func(project string) string
+
+// projectNameSeparators are the runs of characters PEP 503 treats as equal in project names
+var projectNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+// normalizeProjectName normalizes a project name as per PEP 503, e.g. 'Flask_Env' -> 'flask-env'
+func normalizeProjectName(name string) string {
+	return strings.ToLower(projectNameSeparators.ReplaceAllString(name, "-"))
+}
+
+func projectName(a Asset) string {
+	if a.Project != "" {
+		return normalizeProjectName(a.Project)
+	}
+	return normalizeProjectName(a.Repo)
+}
+
+func releaseProjectName(rel Release) string {
+	if rel.Project != "" {
+		return normalizeProjectName(rel.Project)
+	}
+	return normalizeProjectName(rel.Repo)
+}
+
+func projectNames(assets []Asset) []string {
+	var projects = make(map[string]bool)
+	for _, a := range assets {
+		projects[projectName(a)] = true
+	}
+
+	var names = make([]string, 0, len(projects))
+	for project := range projects {
+		names = append(names, project)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func filterAssets(assets []Asset, keep func(a Asset) bool) []Asset {
+	var filtered = make([]Asset, 0)
+	for _, a := range assets {
+		if keep(a) {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+func assetLinks(assets []Asset, link assetLinker) []pageLink {
+	var links = make([]pageLink, 0, len(assets))
+	for _, a := range assets {
+		var l = pageLink{
+			Name:         a.Name,
+			URL:          link(a),
+			Yanked:       a.Yanked,
+			YankedReason: a.YankedReason,
+		}
+		if a.Metadata != nil {
+			l.RequiresPython = a.Metadata.RequiresPython
+		}
+		if _, sum, ok := coreMetadata(a); ok {
+			l.CoreMetadata = "sha256=" + sum
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+func (p *pageTemplates) writeSimpleIndexPage(w io.Writer, projects []string, link projectLinker, stylesheet string) error {
+	var links = make([]pageLink, 0, len(projects))
+	for _, project := range projects {
+		links = append(links, pageLink{Name: project, URL: link(project)})
+	}
+	return p.render(w, "simple-index.html", pageData{
+		Title:      "Simple index",
+		Stylesheet: stylesheet,
+		Links:      links,
+	})
+}
+
+func (p *pageTemplates) writeSimpleProjectPage(w io.Writer, project string, assets []Asset, link assetLinker, stylesheet string) error {
+	return p.render(w, "simple-project.html", pageData{
+		Title:      fmt.Sprintf("Links for %s", project),
+		Heading:    fmt.Sprintf("Links for %s", project),
+		Project:    project,
+		Stylesheet: stylesheet,
+		Links:      assetLinks(assets, link),
+	})
+}
+
+// PEP 691 JSON simple API structures
+type jsonMeta struct {
+	APIVersion string `json:"api-version"`
+}
+
+type jsonProject struct {
+	Name string `json:"name"`
+}
+
+type jsonProjectList struct {
+	Meta     jsonMeta      `json:"meta"`
+	Projects []jsonProject `json:"projects"`
+}
+
+type jsonFile struct {
+	Filename string            `json:"filename"`
+	URL      string            `json:"url"`
+	Hashes   map[string]string `json:"hashes"`
+
+	// Yanked is either true or the reason the file was yanked
+	Yanked interface{} `json:"yanked,omitempty"`
+
+	RequiresPython string `json:"requires-python,omitempty"`
+	// CoreMetadata and DistInfoMetadata (its PEP 658 name) are the hashes of
+	// the .metadata file when there is one
+	CoreMetadata     map[string]string `json:"core-metadata,omitempty"`
+	DistInfoMetadata map[string]string `json:"dist-info-metadata,omitempty"`
+}
+
+type jsonProjectDetail struct {
+	Meta  jsonMeta   `json:"meta"`
+	Name  string     `json:"name"`
+	Files []jsonFile `json:"files"`
+}
+
+func writeSimpleIndexJSON(w io.Writer, projects []string) error {
+	var list = jsonProjectList{
+		Meta:     jsonMeta{APIVersion: "1.0"},
+		Projects: make([]jsonProject, 0, len(projects)),
+	}
+	for _, project := range projects {
+		list.Projects = append(list.Projects, jsonProject{Name: project})
+	}
+	return json.NewEncoder(w).Encode(list)
+}
+
+func writeSimpleProjectJSON(w io.Writer, project string, assets []Asset, link assetLinker, hashes map[string]string) error {
+	var detail = jsonProjectDetail{
+		Meta:  jsonMeta{APIVersion: "1.0"},
+		Name:  project,
+		Files: make([]jsonFile, 0, len(assets)),
+	}
+	for _, a := range assets {
+		var f = jsonFile{
+			Filename: a.Name,
+			URL:      link(a),
+			Hashes:   make(map[string]string),
+		}
+		if h, ok := hashes[a.URL()]; ok {
+			f.Hashes["sha256"] = h
+		}
+		if a.Yanked {
+			f.Yanked = true
+			if a.YankedReason != "" {
+				f.Yanked = a.YankedReason
+			}
+		}
+		if a.Metadata != nil {
+			f.RequiresPython = a.Metadata.RequiresPython
+		}
+		if _, sum, ok := coreMetadata(a); ok {
+			f.CoreMetadata = map[string]string{"sha256": sum}
+			f.DistInfoMetadata = f.CoreMetadata
+		}
+		detail.Files = append(detail.Files, f)
+	}
+	return json.NewEncoder(w).Encode(detail)
+}
@@ -0,0 +1,189 @@
+package pep440
+
+import (
+	"fmt"
+	"strings"
+)
+
+// operators are the comparison operators of version specifiers, longest first
+var operators = []string{"===", "~=", "==", "!=", "<=", ">=", "<", ">"}
+
+// Specifier is a single version clause, e.g. '>=1.0' or '==1.2.*'
+type Specifier struct {
+	Operator string
+	// Version is the version as written, without any '.*' suffix
+	Version  string
+	Wildcard bool
+
+	version Version
+}
+
+// Specifiers is a comma separated list of version clauses, e.g. '>=3.8,<4',
+// which a version has to match every one of
+type Specifiers []Specifier
+
+// ErrInvalidSpecifier is returned for version specifiers which don't follow PEP 440
+type ErrInvalidSpecifier struct {
+	Specifier string
+	Reason    string
+}
+
+func (e ErrInvalidSpecifier) Error() string {
+	return fmt.Sprintf("invalid version specifier %q: %s", e.Specifier, e.Reason)
+}
+
+// ParseSpecifier parses a single version clause
+func ParseSpecifier(s string) (Specifier, error) {
+	var trimmed = strings.TrimSpace(s)
+	var spec Specifier
+	for _, op := range operators {
+		if strings.HasPrefix(trimmed, op) {
+			spec.Operator = op
+			spec.Version = strings.TrimSpace(trimmed[len(op):])
+			break
+		}
+	}
+	if spec.Operator == "" {
+		return Specifier{}, ErrInvalidSpecifier{s, "no comparison operator"}
+	}
+	if spec.Version == "" {
+		return Specifier{}, ErrInvalidSpecifier{s, "no version"}
+	}
+	if spec.Operator == "===" {
+		// Arbitrary equality compares strings, the version needn't be valid
+		return spec, nil
+	}
+
+	if strings.HasSuffix(spec.Version, ".*") {
+		if spec.Operator != "==" && spec.Operator != "!=" {
+			return Specifier{}, ErrInvalidSpecifier{s, "only == and != allow a .* suffix"}
+		}
+		spec.Wildcard = true
+		spec.Version = strings.TrimSuffix(spec.Version, ".*")
+	}
+
+	var err error
+	spec.version, err = Parse(spec.Version)
+	if err != nil {
+		return Specifier{}, ErrInvalidSpecifier{s, err.Error()}
+	}
+	var v = spec.version
+	switch {
+	case spec.Wildcard && (v.PreLabel != "" || v.Post >= 0 || v.Dev >= 0 || len(v.Local) > 0):
+		return Specifier{}, ErrInvalidSpecifier{s, "a .* suffix may only follow a release"}
+	case len(v.Local) > 0 && spec.Operator != "==" && spec.Operator != "!=":
+		return Specifier{}, ErrInvalidSpecifier{s, "only == and != allow a local version"}
+	case spec.Operator == "~=" && len(v.Release) < 2:
+		return Specifier{}, ErrInvalidSpecifier{s, "~= needs at least two release segments"}
+	}
+	return spec, nil
+}
+
+// ParseSpecifiers parses a comma separated list of version clauses, an empty
+// list matches every version
+func ParseSpecifiers(s string) (Specifiers, error) {
+	var specs = make(Specifiers, 0)
+	if strings.TrimSpace(s) == "" {
+		return specs, nil
+	}
+	for _, clause := range strings.Split(s, ",") {
+		var spec, err = ParseSpecifier(clause)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func (s Specifier) String() string {
+	if s.Wildcard {
+		return s.Operator + s.Version + ".*"
+	}
+	return s.Operator + s.Version
+}
+
+func (s Specifiers) String() string {
+	var clauses = make([]string, 0, len(s))
+	for _, spec := range s {
+		clauses = append(clauses, spec.String())
+	}
+	return strings.Join(clauses, ",")
+}
+
+// hasPrefix reports whether the release of v starts with prefix, padding v with zeros
+func hasPrefix(v Version, epoch int, prefix []int) bool {
+	if v.Epoch != epoch {
+		return false
+	}
+	for i, n := range prefix {
+		var m int
+		if i < len(v.Release) {
+			m = v.Release[i]
+		}
+		if m != n {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether v matches the clause. Pre-releases aren't treated
+// specially beyond what the operators require, callers decide whether they
+// want to consider them at all.
+func (s Specifier) Contains(v Version) bool {
+	var spec = s.version
+	var candidate = v
+	if len(spec.Local) == 0 {
+		// Local version labels are ignored unless the clause has one
+		candidate = v.Public()
+	}
+
+	switch s.Operator {
+	case "===":
+		var original = v.Original()
+		if original == "" {
+			original = v.String()
+		}
+		return strings.EqualFold(strings.TrimSpace(original), s.Version)
+	case "==":
+		if s.Wildcard {
+			return hasPrefix(candidate, spec.Epoch, spec.Release)
+		}
+		return candidate.Compare(spec) == 0
+	case "!=":
+		if s.Wildcard {
+			return !hasPrefix(candidate, spec.Epoch, spec.Release)
+		}
+		return candidate.Compare(spec) != 0
+	case "~=":
+		return candidate.Compare(spec) >= 0 && hasPrefix(candidate, spec.Epoch, spec.Release[:len(spec.Release)-1])
+	case "<=":
+		return candidate.Compare(spec) <= 0
+	case ">=":
+		return candidate.Compare(spec) >= 0
+	case "<":
+		// '<1.0' doesn't match pre-releases of 1.0 unless it is one itself
+		if candidate.IsPrerelease() && !spec.IsPrerelease() && candidate.Base().Compare(spec.Base()) == 0 {
+			return false
+		}
+		return candidate.Compare(spec) < 0
+	case ">":
+		// '>1.0' doesn't match post-releases or local versions of 1.0
+		if v.Base().Compare(spec.Base()) == 0 && (v.IsPostrelease() && !spec.IsPostrelease() || len(v.Local) > 0) {
+			return false
+		}
+		return candidate.Compare(spec) > 0
+	}
+	return false
+}
+
+// Contains reports whether v matches every clause
+func (s Specifiers) Contains(v Version) bool {
+	for _, spec := range s {
+		if !spec.Contains(v) {
+			return false
+		}
+	}
+	return true
+}
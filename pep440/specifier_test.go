@@ -0,0 +1,190 @@
+package pep440
+
+import "testing"
+
+func TestParseSpecifiers(t *testing.T) {
+	var tests = []struct {
+		specifiers string
+		want       string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{">=1.0", ">=1.0"},
+		{" >= 1.0 , < 2 ", ">=1.0,<2"},
+		{"==1.0.*", "==1.0.*"},
+		{"!=1.1.*,~=1.0", "!=1.1.*,~=1.0"},
+		{"===foobar", "===foobar"},
+		{"==1.0+local", "==1.0+local"},
+	}
+
+	for _, test := range tests {
+		var got, err = ParseSpecifiers(test.specifiers)
+		if err != nil {
+			t.Errorf("ParseSpecifiers(%q) error: %s", test.specifiers, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("ParseSpecifiers(%q) = %q, want %q", test.specifiers, got, test.want)
+		}
+	}
+}
+
+func TestParseSpecifierInvalid(t *testing.T) {
+	var tests = []struct {
+		specifier string
+		reason    string
+	}{
+		{"1.0", "no comparison operator"},
+		{"=>1.0", "no comparison operator"},
+		{">=", "no version"},
+		{">=1.0.*", "only == and != allow a .* suffix"},
+		{"~=1.0.*", "only == and != allow a .* suffix"},
+		{"==1.0a1.*", "a .* suffix may only follow a release"},
+		{"==1.0+local.*", "a .* suffix may only follow a release"},
+		{">=1.0+local", "only == and != allow a local version"},
+		{"~=1", "~= needs at least two release segments"},
+		{"==latest", `invalid version "latest"`},
+	}
+
+	for _, test := range tests {
+		var spec, err = ParseSpecifier(test.specifier)
+		if err == nil {
+			t.Errorf("ParseSpecifier(%q) = %s, want an error", test.specifier, spec)
+			continue
+		}
+		var invalid, ok = err.(ErrInvalidSpecifier)
+		if !ok || invalid.Reason != test.reason {
+			t.Errorf("ParseSpecifier(%q) error = %q, want reason %q", test.specifier, err, test.reason)
+		}
+	}
+
+	if _, err := ParseSpecifiers(">=1.0,"); err == nil {
+		t.Error("ParseSpecifiers(\">=1.0,\") should fail on the empty clause")
+	}
+}
+
+func TestSpecifierContains(t *testing.T) {
+	var tests = []struct {
+		specifiers string
+		version    string
+		want       bool
+	}{
+		// Version matching, release segments are padded with zeros
+		{"==1.1", "1.1", true},
+		{"==1.1", "1.1.0", true},
+		{"==1.1", "1.1.post1", false},
+		{"==1.1", "1.1a1", false},
+		{"==1.1.0", "1.1", true},
+		// Local versions are ignored unless the clause has one
+		{"==1.1", "1.1+local", true},
+		{"==1.1+local", "1.1+local", true},
+		{"==1.1+local", "1.1", false},
+		{"==1.1+local", "1.1+other", false},
+		// Prefix matching
+		{"==1.1.*", "1.1", true},
+		{"==1.1.*", "1.1.post1", true},
+		{"==1.1.*", "1.1a1", true},
+		{"==1.1.*", "1.1.5+local", true},
+		{"==1.1.*", "1.10", false},
+		{"==1.1.*", "1.2", false},
+		{"==1.1.*", "1!1.1", false},
+		{"==1!1.1.*", "1!1.1.3", true},
+		{"==1.0.0.*", "1", true},
+
+		// Version exclusion
+		{"!=1.1", "1.1", false},
+		{"!=1.1", "1.1.0+local", false},
+		{"!=1.1", "1.1.post1", true},
+		{"!=1.1.*", "1.1.post1", false},
+		{"!=1.1.*", "1.2", true},
+
+		// Compatible release, '~=2.2' is '>=2.2,==2.*'
+		{"~=2.2", "2.2", true},
+		{"~=2.2", "2.3", true},
+		{"~=2.2", "2.2.post3", true},
+		{"~=2.2", "2.1", false},
+		{"~=2.2", "3.0", false},
+		// '~=1.4.5' is '>=1.4.5,==1.4.*'
+		{"~=1.4.5", "1.4.5", true},
+		{"~=1.4.5", "1.4.9", true},
+		{"~=1.4.5", "1.5.0", false},
+		{"~=1.4.5", "1.4.4", false},
+		// Pre, post and development releases of the clause
+		{"~=1.4.5a4", "1.4.5a4", true},
+		{"~=1.4.5a4", "1.4.5", true},
+		{"~=1.4.5a4", "1.4.5a3", false},
+		{"~=2.2.post3", "2.2.post3", true},
+		{"~=2.2.post3", "2.9", true},
+		{"~=2.2.post3", "2.2.post2", false},
+		{"~=2.2.0", "2.2.0.dev1", false},
+		{"~=1!2.2", "1!2.5", true},
+		{"~=1!2.2", "2.5", false},
+
+		// Inclusive ordered comparison
+		{"<=2.0", "2.0", true},
+		{"<=2.0", "2.0+local", true},
+		{"<=2.0", "2.0.post1", false},
+		{"<=2.0", "1.9", true},
+		{">=2.0", "2.0", true},
+		{">=2.0", "2.0rc1", false},
+		{">=2.0", "2.0.post1", true},
+		{">=2.0", "1!1.0", true},
+
+		// Exclusive ordered comparison
+		{"<2.0", "1.9", true},
+		{"<2.0", "2.0", false},
+		{"<2.0", "1.9.post1", true},
+		// '<2.0' doesn't match pre-releases of 2.0 ...
+		{"<2.0", "2.0rc1", false},
+		{"<2.0", "2.0a1", false},
+		{"<2.0", "2.0.dev1", false},
+		{"<2.0", "1.9rc1", true},
+		// ... unless it is a pre-release itself
+		{"<2.0rc2", "2.0rc1", true},
+		{"<2.0rc2", "2.0b1", true},
+		{"<2.0rc2", "2.0rc2", false},
+		{">1.7", "1.7.1", true},
+		{">1.7", "1.7", false},
+		{">1.7", "1.8.dev1", true},
+		// '>1.7' doesn't match post-releases or local versions of 1.7 ...
+		{">1.7", "1.7.post2", false},
+		{">1.7", "1.7.0.post2", false},
+		{">1.7", "1.7+local", false},
+		{">1.7", "1.7.1+local", true},
+		// ... unless it is a post-release itself
+		{">1.7.post2", "1.7.post3", true},
+		{">1.7.post2", "1.7.post2", false},
+		{">1.7.post2", "1.7.1", true},
+
+		// Arbitrary equality compares strings
+		{"===foobar", "foobar", true},
+		{"===1.0", "1.0", true},
+		{"===1.0", "1.0.0", false},
+		{"===1.0", "v1.0", false},
+
+		// Every clause has to match
+		{"", "1.0", true},
+		{">=1.0,<2.0", "1.5", true},
+		{">=1.0,<2.0", "2.0", false},
+		{">=1.0,!=1.5.*,<2.0", "1.5.1", false},
+		{">=1.0,!=1.5.*,<2.0", "1.6", true},
+	}
+
+	for _, test := range tests {
+		var specs, err = ParseSpecifiers(test.specifiers)
+		if err != nil {
+			t.Errorf("ParseSpecifiers(%q) error: %s", test.specifiers, err)
+			continue
+		}
+		var v Version
+		if test.specifiers == "===foobar" {
+			// Arbitrary equality is the only way to match versions which aren't valid
+			v = Version{original: test.version}
+		} else {
+			v = MustParse(test.version)
+		}
+		if got := specs.Contains(v); got != test.want {
+			t.Errorf("%q Contains(%q) = %t, want %t", test.specifiers, test.version, got, test.want)
+		}
+	}
+}
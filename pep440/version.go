@@ -0,0 +1,317 @@
+// Package pep440 parses, normalizes and compares Python package versions and
+// version specifiers, see https://peps.python.org/pep-0440/
+package pep440
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionPattern is the permissive version pattern from PEP 440 appendix B,
+// which also accepts the alternative spellings normalization removes
+var versionPattern = regexp.MustCompile(`(?i)^\s*v?` +
+	`(?:(?P<epoch>[0-9]+)!)?` +
+	`(?P<release>[0-9]+(?:\.[0-9]+)*)` +
+	`(?P<pre>[-_.]?(?P<pre_l>alpha|a|beta|b|preview|pre|c|rc)[-_.]?(?P<pre_n>[0-9]+)?)?` +
+	`(?P<post>(?:-(?P<post_n1>[0-9]+))|(?:[-_.]?(?P<post_l>post|rev|r)[-_.]?(?P<post_n2>[0-9]+)?))?` +
+	`(?P<dev>[-_.]?(?P<dev_l>dev)[-_.]?(?P<dev_n>[0-9]+)?)?` +
+	`(?:\+(?P<local>[a-z0-9]+(?:[-_.][a-z0-9]+)*))?` +
+	`\s*$`)
+
+// Version is a parsed PEP 440 version
+type Version struct {
+	Epoch   int
+	Release []int
+
+	// PreLabel is one of 'a' 'b' or 'rc', or empty when this isn't a pre-release
+	PreLabel string
+	Pre      int
+
+	// Post and Dev are -1 when this isn't a post or a development release
+	Post int
+	Dev  int
+
+	// Local is the dot separated, lower cased parts of the local version label
+	Local []string
+
+	original string
+}
+
+// ErrInvalidVersion is returned for versions which don't follow PEP 440
+type ErrInvalidVersion struct {
+	Version string
+}
+
+func (e ErrInvalidVersion) Error() string {
+	return fmt.Sprintf("invalid version %q", e.Version)
+}
+
+func atoi(s string) (int, bool) {
+	if s == "" {
+		return 0, true
+	}
+	var n, err = strconv.Atoi(s)
+	return n, err == nil
+}
+
+// Parse parses a version, accepting every spelling PEP 440 normalizes
+func Parse(s string) (Version, error) {
+	var m = versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Version{}, ErrInvalidVersion{s}
+	}
+	var group = func(name string) string {
+		return m[versionPattern.SubexpIndex(name)]
+	}
+
+	var v = Version{Post: -1, Dev: -1, original: s}
+	var ok bool
+	if v.Epoch, ok = atoi(group("epoch")); !ok {
+		return Version{}, ErrInvalidVersion{s}
+	}
+	for _, part := range strings.Split(group("release"), ".") {
+		var n int
+		if n, ok = atoi(part); !ok {
+			return Version{}, ErrInvalidVersion{s}
+		}
+		v.Release = append(v.Release, n)
+	}
+
+	if group("pre") != "" {
+		switch strings.ToLower(group("pre_l")) {
+		case "a", "alpha":
+			v.PreLabel = "a"
+		case "b", "beta":
+			v.PreLabel = "b"
+		default:
+			v.PreLabel = "rc"
+		}
+		if v.Pre, ok = atoi(group("pre_n")); !ok {
+			return Version{}, ErrInvalidVersion{s}
+		}
+	}
+	if group("post") != "" {
+		var n = group("post_n1")
+		if n == "" {
+			n = group("post_n2")
+		}
+		if v.Post, ok = atoi(n); !ok {
+			return Version{}, ErrInvalidVersion{s}
+		}
+	}
+	if group("dev") != "" {
+		if v.Dev, ok = atoi(group("dev_n")); !ok {
+			return Version{}, ErrInvalidVersion{s}
+		}
+	}
+	if local := group("local"); local != "" {
+		v.Local = strings.FieldsFunc(strings.ToLower(local), func(r rune) bool {
+			return r == '-' || r == '_' || r == '.'
+		})
+	}
+	return v, nil
+}
+
+// MustParse is like Parse but panics when s isn't a valid version
+func MustParse(s string) Version {
+	var v, err = Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Normalize returns the normalized form of the version s, e.g. '1.0-RC.1' -> '1.0rc1'
+func Normalize(s string) (string, error) {
+	var v, err = Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// Valid reports whether s is a PEP 440 version
+func Valid(s string) bool {
+	var _, err = Parse(s)
+	return err == nil
+}
+
+// Original returns the version as it was given to Parse
+func (v Version) Original() string {
+	return v.original
+}
+
+// Public returns the version without its local version label
+func (v Version) Public() Version {
+	v.Local = nil
+	return v
+}
+
+// Base returns the epoch and release segments of the version only, e.g. '1.0' for '1.0rc1.post2'
+func (v Version) Base() Version {
+	return Version{Epoch: v.Epoch, Release: v.Release, Post: -1, Dev: -1}
+}
+
+// IsPrerelease reports whether this is a pre-release or a development release
+func (v Version) IsPrerelease() bool {
+	return v.PreLabel != "" || v.Dev >= 0
+}
+
+// IsPostrelease reports whether this is a post-release
+func (v Version) IsPostrelease() bool {
+	return v.Post >= 0
+}
+
+// String returns the normalized form of the version
+func (v Version) String() string {
+	var b strings.Builder
+	if v.Epoch != 0 {
+		fmt.Fprintf(&b, "%d!", v.Epoch)
+	}
+	for i, n := range v.Release {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(strconv.Itoa(n))
+	}
+	if v.PreLabel != "" {
+		fmt.Fprintf(&b, "%s%d", v.PreLabel, v.Pre)
+	}
+	if v.Post >= 0 {
+		fmt.Fprintf(&b, ".post%d", v.Post)
+	}
+	if v.Dev >= 0 {
+		fmt.Fprintf(&b, ".dev%d", v.Dev)
+	}
+	if len(v.Local) > 0 {
+		b.WriteByte('+')
+		b.WriteString(strings.Join(v.Local, "."))
+	}
+	return b.String()
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareRelease compares release segments as if the shorter one was padded with zeros
+func compareRelease(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if c := compareInts(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// preRank orders the pre-release segment: development releases of the final
+// release come first, then alphas, betas and release candidates, then the
+// final release itself
+func (v Version) preRank() (int, int) {
+	switch {
+	case v.PreLabel == "a":
+		return 1, v.Pre
+	case v.PreLabel == "b":
+		return 2, v.Pre
+	case v.PreLabel == "rc":
+		return 3, v.Pre
+	case v.Post < 0 && v.Dev >= 0:
+		return 0, 0
+	}
+	return 4, 0
+}
+
+// compareLocal compares local version labels, numeric parts are compared
+// numerically and sort after alphanumeric ones
+func compareLocal(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		var x, xerr = strconv.Atoi(a[i])
+		var y, yerr = strconv.Atoi(b[i])
+		switch {
+		case xerr == nil && yerr == nil:
+			if c := compareInts(x, y); c != 0 {
+				return c
+			}
+		case xerr == nil:
+			return 1
+		case yerr == nil:
+			return -1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+// Compare returns -1, 0 or 1 when v sorts before, the same as or after w
+func (v Version) Compare(w Version) int {
+	if c := compareInts(v.Epoch, w.Epoch); c != 0 {
+		return c
+	}
+	if c := compareRelease(v.Release, w.Release); c != 0 {
+		return c
+	}
+
+	var vRank, vPre = v.preRank()
+	var wRank, wPre = w.preRank()
+	if c := compareInts(vRank, wRank); c != 0 {
+		return c
+	}
+	if c := compareInts(vPre, wPre); c != 0 {
+		return c
+	}
+	if c := compareInts(v.Post, w.Post); c != 0 {
+		return c
+	}
+
+	// Releases without a development segment sort after those with one
+	var vDev, wDev = v.Dev, w.Dev
+	if vDev < 0 {
+		vDev = int(^uint(0) >> 1)
+	}
+	if wDev < 0 {
+		wDev = int(^uint(0) >> 1)
+	}
+	if c := compareInts(vDev, wDev); c != 0 {
+		return c
+	}
+	return compareLocal(v.Local, w.Local)
+}
+
+// Less reports whether v sorts before w
+func (v Version) Less(w Version) bool {
+	return v.Compare(w) < 0
+}
+
+// Compare parses and compares two versions, invalid versions sort before
+// every valid version and are compared as strings between themselves
+func Compare(a string, b string) int {
+	var v, verr = Parse(a)
+	var w, werr = Parse(b)
+	switch {
+	case verr == nil && werr == nil:
+		return v.Compare(w)
+	case verr == nil:
+		return 1
+	case werr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
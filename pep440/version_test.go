@@ -0,0 +1,190 @@
+package pep440
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	var tests = []struct {
+		version string
+		want    string
+	}{
+		{"1.0", "1.0"},
+		{"v1.0", "1.0"},
+		{" 1.0\n", "1.0"},
+		{"01.002.0", "1.2.0"},
+		{"1!2.0", "1!2.0"},
+		{"0!1.0", "1.0"},
+
+		// Pre-releases
+		{"1.0a1", "1.0a1"},
+		{"1.0alpha1", "1.0a1"},
+		{"1.0.a.1", "1.0a1"},
+		{"1.0-beta_2", "1.0b2"},
+		{"1.0c1", "1.0rc1"},
+		{"1.0pre1", "1.0rc1"},
+		{"1.0preview1", "1.0rc1"},
+		{"1.0-RC.1", "1.0rc1"},
+		{"1.0a", "1.0a0"},
+
+		// Post-releases
+		{"1.0.post1", "1.0.post1"},
+		{"1.0post1", "1.0.post1"},
+		{"1.0-post-1", "1.0.post1"},
+		{"1.0-r4", "1.0.post4"},
+		{"1.0rev4", "1.0.post4"},
+		{"1.0-1", "1.0.post1"},
+		{"1.0.post", "1.0.post0"},
+
+		// Development releases
+		{"1.0.dev1", "1.0.dev1"},
+		{"1.0dev1", "1.0.dev1"},
+		{"1.0-dev", "1.0.dev0"},
+		{"1.0a1.post2.dev3", "1.0a1.post2.dev3"},
+
+		// Local versions
+		{"1.0+abc.5", "1.0+abc.5"},
+		{"1.0+ubuntu-1", "1.0+ubuntu.1"},
+		{"1.0+Ubuntu_1", "1.0+ubuntu.1"},
+	}
+
+	for _, test := range tests {
+		var got, err = Normalize(test.version)
+		if err != nil {
+			t.Errorf("Normalize(%q) error: %s", test.version, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, version := range []string{"", "latest", "1.0.", ".1", "1..0", "1.0-", "1.0+", "1.0+a!b", "1.0a1a2", "1.0-1-1", "release-2020", "1.0 beta"} {
+		if v, err := Parse(version); err == nil {
+			t.Errorf("Parse(%q) = %s, want an error", version, v)
+		}
+		if Valid(version) {
+			t.Errorf("Valid(%q) = true, want false", version)
+		}
+	}
+}
+
+func TestVersionPredicates(t *testing.T) {
+	var tests = []struct {
+		version     string
+		prerelease  bool
+		postrelease bool
+		public      string
+		base        string
+	}{
+		{"1.0", false, false, "1.0", "1.0"},
+		{"1.0a1", true, false, "1.0a1", "1.0"},
+		{"1.0.dev1", true, false, "1.0.dev1", "1.0"},
+		{"1.0.post1", false, true, "1.0.post1", "1.0"},
+		{"1.0.post1.dev1", true, true, "1.0.post1.dev1", "1.0"},
+		{"1!1.0rc1+local.7", true, false, "1!1.0rc1", "1!1.0"},
+	}
+
+	for _, test := range tests {
+		var v = MustParse(test.version)
+		if got := v.IsPrerelease(); got != test.prerelease {
+			t.Errorf("%s IsPrerelease() = %t, want %t", test.version, got, test.prerelease)
+		}
+		if got := v.IsPostrelease(); got != test.postrelease {
+			t.Errorf("%s IsPostrelease() = %t, want %t", test.version, got, test.postrelease)
+		}
+		if got := v.Public().String(); got != test.public {
+			t.Errorf("%s Public() = %s, want %s", test.version, got, test.public)
+		}
+		if got := v.Base().String(); got != test.base {
+			t.Errorf("%s Base() = %s, want %s", test.version, got, test.base)
+		}
+		if got := v.Original(); got != test.version {
+			t.Errorf("%s Original() = %s", test.version, got)
+		}
+	}
+}
+
+// TestOrdering checks the relative ordering example from PEP 440, along with
+// epochs, every version must sort after all of the ones before it
+func TestOrdering(t *testing.T) {
+	var versions = []string{
+		"1.dev0",
+		"1.0.dev456",
+		"1.0a1",
+		"1.0a2.dev456",
+		"1.0a12.dev456",
+		"1.0a12",
+		"1.0b1.dev456",
+		"1.0b2",
+		"1.0b2.post345.dev456",
+		"1.0b2.post345",
+		"1.0rc1.dev456",
+		"1.0rc1",
+		"1.0",
+		"1.0+abc.5",
+		"1.0+abc.7",
+		"1.0+5",
+		"1.0.post456.dev34",
+		"1.0.post456",
+		"1.0.15",
+		"1.1.dev1",
+		"2.0",
+		"10.0",
+		"1!0.1",
+		"1!1.0",
+	}
+
+	for i := range versions {
+		for j := range versions {
+			var want = compareInts(i, j)
+			if got := Compare(versions[i], versions[j]); got != want {
+				t.Errorf("Compare(%q, %q) = %d, want %d", versions[i], versions[j], got, want)
+			}
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	var tests = []struct {
+		a    string
+		b    string
+		want int
+	}{
+		// Release segments are padded with zeros
+		{"1.0", "1.0.0", 0},
+		{"1", "1.0.0.0", 0},
+		{"1.0.1", "1.0", 1},
+		// Alternative spellings compare equal to their normalized form
+		{"v1.0-RC.1", "1.0rc1", 0},
+		{"1.0-1", "1.0.post1", 0},
+		{"1.0+Ubuntu-1", "1.0+ubuntu.1", 0},
+		// Local versions sort after their public version
+		{"1.0+local", "1.0", 1},
+		{"1.0+abc", "1.0+abc.1", -1},
+		{"1.0+2", "1.0+10", -1},
+		{"1.0+a", "1.0+1", -1},
+		// Invalid versions sort before valid ones, and as strings between themselves
+		{"latest", "0.0.1", -1},
+		{"1.0", "nightly", 1},
+		{"latest", "nightly", -1},
+	}
+
+	for _, test := range tests {
+		if got := Compare(test.a, test.b); got != test.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := Compare(test.b, test.a); got != -test.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestLess(t *testing.T) {
+	if !MustParse("1.0rc1").Less(MustParse("1.0")) {
+		t.Error("1.0rc1 should be less than 1.0")
+	}
+	if MustParse("1.0").Less(MustParse("1.0.0")) {
+		t.Error("1.0 shouldn't be less than 1.0.0")
+	}
+}
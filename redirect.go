@@ -0,0 +1,133 @@
+package pypihub
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redirectExpiryMargin is how long before a download URL expires we stop handing it out
+const redirectExpiryMargin = 30 * time.Second
+
+type cachedRedirect struct {
+	url     string
+	expires time.Time
+}
+
+// redirectCache remembers the short lived download URLs GitHub hands out, so
+// repeated downloads of the same asset don't each cost an API call
+type redirectCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRedirect
+}
+
+func newRedirectCache() *redirectCache {
+	return &redirectCache{
+		entries: make(map[string]cachedRedirect),
+	}
+}
+
+func (c *redirectCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry, ok = c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.url, true
+}
+
+func (c *redirectCache) Set(key string, u string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var now = time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedRedirect{url: u, expires: expires}
+}
+
+// redirectExpiry works out when a signed download URL expires from its query
+// string, supporting both S3 (X-Amz-Date + X-Amz-Expires) and Azure (se)
+// style signatures; it reports false when the URL carries no expiry
+func redirectExpiry(u string) (time.Time, bool) {
+	var parsed, err = url.Parse(u)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var q = parsed.Query()
+
+	if date, expires := q.Get("X-Amz-Date"), q.Get("X-Amz-Expires"); date != "" && expires != "" {
+		var start, err = time.Parse("20060102T150405Z", date)
+		if err != nil {
+			return time.Time{}, false
+		}
+		var secs int
+		secs, err = strconv.Atoi(expires)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return start.Add(time.Duration(secs) * time.Second), true
+	}
+
+	if se := q.Get("se"); se != "" {
+		var end, err = time.Parse(time.RFC3339, se)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return end, true
+	}
+
+	return time.Time{}, false
+}
+
+// redirectAsset sends the client to download the asset directly from GitHub,
+// falling back to proxying it when GitHub won't give us a URL to hand out; it
+// reports whether the URL came from the redirect cache
+func (r *Router) redirectAsset(w http.ResponseWriter, req *http.Request, a Asset) bool {
+	var key = assetSource(a)
+	if r.config.CacheRedirects {
+		var _, span = startSpan(req.Context(), "redirect cache get", trace.SpanKindInternal, attribute.String("cache.key", key))
+		var u, ok = r.redirects.Get(key)
+		span.SetAttributes(attribute.Bool("cache.hit", ok))
+		span.End()
+		if ok {
+			http.Redirect(w, req, u, http.StatusFound)
+			return true
+		}
+	}
+
+	var u, err = r.client.Locate(req.Context(), a)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return false
+		}
+		slog.WarnContext(req.Context(), "error locating asset, falling back to proxying", "asset", a.URL(), "error", err)
+		r.proxyAsset(w, req, a)
+		return false
+	}
+
+	if r.config.CacheRedirects {
+		if expires, ok := redirectExpiry(u); ok && time.Until(expires) > redirectExpiryMargin {
+			var _, span = startSpan(req.Context(), "redirect cache set", trace.SpanKindInternal, attribute.String("cache.key", key))
+			r.redirects.Set(key, u, expires.Add(-redirectExpiryMargin))
+			span.End()
+		}
+	}
+	http.Redirect(w, req, u, http.StatusFound)
+	return false
+}
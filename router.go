@@ -1,86 +1,145 @@
 package pypihub
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
 
 type Router struct {
-	config Config
-	client *Client
-	assets []Asset
-	timer  *time.Timer
-}
+	config    Config
+	client    *Client
+	syncer    *syncer
+	redirects *redirectCache
+	tokens    *tokenStore
+	auditLog  *auditLogger
+	pages     *pageTemplates
+	metrics   *metrics
 
-func NewRouter(config Config) *Router {
-	return &Router{
-		config: config,
-		client: NewClient(config),
-		assets: make([]Asset, 0),
-	}
+	authenticators []authenticator
 }
 
-func (r *Router) refetchAssets() {
-	go r.startAssetsTimer()
+func NewRouter(config Config) (*Router, error) {
+	var client = NewClient(config)
+	var r = &Router{
+		config:    config,
+		client:    client,
+		syncer:    newSyncer(config, client),
+		redirects: newRedirectCache(),
+		metrics:   newMetrics(),
+	}
+	r.metrics.registry.MustRegister(
+		client.upstream.requests,
+		client.upstream.durations,
+		&statusCollector{client: r.client, syncer: r.syncer},
+	)
 
-	log.Printf("refetching assets for %d repos", len(r.config.RepoNames))
 	var err error
-	r.assets, err = r.client.GetAllAssets()
+	r.pages, err = loadPageTemplates(config.Templates)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+
+	if config.AuditLog != "" {
+		r.auditLog, err = newAuditLogger(config)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %s", err)
+		}
 	}
-	log.Printf("found %d assets for %d repos", len(r.assets), len(r.config.RepoNames))
-}
 
-func (r *Router) startAssetsTimer() {
-	if r.timer != nil {
-		r.timer.Stop()
+	if config.TLSClientCA != "" {
+		var c, err = newClientCertAuthenticator(config)
+		if err != nil {
+			return nil, err
+		}
+		r.authenticators = append(r.authenticators, c)
+	}
+	if config.Htpasswd != "" {
+		var h, err = newHtpasswd(config.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		r.authenticators = append(r.authenticators, h)
+	}
+	if config.TokensFile != "" {
+		r.tokens, err = newTokenStore(config.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		r.authenticators = append(r.authenticators, r.tokens)
 	}
-	r.timer = time.AfterFunc(5*time.Minute, r.refetchAssets)
+	if config.OIDCIssuer != "" {
+		var o, err = newOIDCAuthenticator(config)
+		if err != nil {
+			return nil, err
+		}
+		r.authenticators = append(r.authenticators, o)
+	}
+	if config.GitHubAuth {
+		r.authenticators = append(r.authenticators, newGitHubAuthenticator(config, client))
+	}
+	return r, nil
 }
 
-func (r *Router) handleSimple(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprintf(w, "<html><title>Simple index</title><meta name=\"api-version\" value=\"2\" /><body>")
-	var projects = make(map[string]bool)
-	for _, a := range r.assets {
-		projects[strings.ToLower(a.Repo)] = true
+func (r *Router) assetLink(a Asset) string {
+	return a.URL()
+}
+
+func (r *Router) projectLink(project string) string {
+	return fmt.Sprintf("/simple/%s", project)
+}
+
+func (r *Router) stylesheet() string {
+	if r.pages.HasStylesheet() {
+		return "/" + stylesheetPath
 	}
+	return ""
+}
 
-	for project := range projects {
-		fmt.Fprintf(w, "<a href=\"/simple/%s\">%s</a> ", project, project)
+// writePage renders a page in full before sending it, so a failing template
+// results in an error response rather than half a page
+func (r *Router) writePage(w http.ResponseWriter, req *http.Request, render func(w io.Writer) error) {
+	var buf bytes.Buffer
+	if err := render(&buf); err != nil {
+		slog.ErrorContext(req.Context(), "error rendering page", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
-	fmt.Fprintf(w, "</body></html>")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (r *Router) handleSimple(w http.ResponseWriter, req *http.Request) {
+	r.writePage(w, req, func(w io.Writer) error {
+		return r.pages.writeSimpleIndexPage(w, projectNames(r.visibleAssets(req)), r.projectLink, r.stylesheet())
+	})
 }
 
 func (r *Router) handleSimpleProject(w http.ResponseWriter, req *http.Request) {
 	var vars map[string]string
 	vars = mux.Vars(req)
-	var repo = strings.ToLower(vars["repo"])
+	var repo = normalizeProjectName(vars["repo"])
 
-	fmt.Fprintf(w, "<html><title>Links for %s</title><meta name=\"api-version\" value=\"2\" /><body>", repo)
-	fmt.Fprintf(w, "<h1>Links for all %s</h1>", repo)
-	for _, a := range r.assets {
-		if strings.ToLower(a.Repo) == repo {
-			fmt.Fprintf(w, "<a href=\"%s\">%s</a> ", a.URL(), a.Name)
-		}
-	}
-	fmt.Fprintf(w, "</body></html>")
+	var assets = filterAssets(r.visibleAssets(req), func(a Asset) bool {
+		return projectName(a) == repo
+	})
+	r.writePage(w, req, func(w io.Writer) error {
+		return r.pages.writeSimpleProjectPage(w, repo, assets, r.assetLink, r.stylesheet())
+	})
 }
 
 func (r *Router) handleIndex(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprintf(w, "<html><title>Links for all projects</title><body>")
-	fmt.Fprintf(w, "<h1>Links for all projects</h1>")
-	for _, a := range r.assets {
-		fmt.Fprintf(w, "<a href=\"%s\">%s</a> ", a.URL(), a.Name)
-	}
-	fmt.Fprintf(w, "</body></html>")
+	r.writeProjects(w, req, "Projects", "Projects", r.visibleAssets(req))
 }
 
 func (r *Router) handleFavicon(w http.ResponseWriter, req *http.Request) {
@@ -94,19 +153,20 @@ func (r *Router) handleFavicon(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "%s", decoded)
 }
 
+func (r *Router) handleStylesheet(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Write(r.pages.css)
+}
+
 func (r *Router) handleOwnerIndex(w http.ResponseWriter, req *http.Request) {
 	var vars map[string]string
 	vars = mux.Vars(req)
 	var owner = strings.ToLower(vars["owner"])
 
-	fmt.Fprintf(w, "<html><title>Packages for %s</title><body>", owner)
-	fmt.Fprintf(w, "<h1>Links for %s projects</h1>", owner)
-	for _, a := range r.assets {
-		if strings.ToLower(a.Owner) == owner {
-			fmt.Fprintf(w, "<a href=\"%s\">%s</a> ", a.URL(), a.Name)
-		}
-	}
-	fmt.Fprintf(w, "</body></html>")
+	var assets = filterAssets(r.visibleAssets(req), func(a Asset) bool {
+		return strings.ToLower(a.Owner) == owner
+	})
+	r.writeProjects(w, req, fmt.Sprintf("Projects by %s", owner), fmt.Sprintf("Projects by %s", owner), assets)
 }
 
 func (r *Router) handleRepoIndex(w http.ResponseWriter, req *http.Request) {
@@ -115,45 +175,81 @@ func (r *Router) handleRepoIndex(w http.ResponseWriter, req *http.Request) {
 	var owner = strings.ToLower(vars["owner"])
 	var repo = strings.ToLower(vars["repo"])
 
-	fmt.Fprintf(w, "<html><title>Packages for %s/%s</title><body>", owner, repo)
-	fmt.Fprintf(w, "<h1>Links for all %s/%s</h1>", owner, repo)
-	for _, a := range r.assets {
-		if strings.ToLower(a.Owner) == owner && strings.ToLower(a.Repo) == repo {
-			fmt.Fprintf(w, "<a href=\"%s\">%s</a> ", a.URL(), a.Name)
+	var assets = filterAssets(r.visibleAssets(req), func(a Asset) bool {
+		return strings.ToLower(a.Owner) == owner && strings.ToLower(a.Repo) == repo
+	})
+	if len(assets) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Repos with several packages list them, each having its own page
+	var project = normalizeProjectName(req.URL.Query().Get("project"))
+	if project == "" {
+		if projects := projectNames(assets); len(projects) > 1 {
+			r.writeProjects(w, req, fmt.Sprintf("Projects in %s/%s", owner, repo), fmt.Sprintf("Projects in %s/%s", owner, repo), assets)
+			return
+		}
+		project = projectName(assets[0])
+	}
+	assets = filterAssets(assets, func(a Asset) bool {
+		return projectName(a) == project
+	})
+	if len(assets) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var a = assets[0]
+	var install = func(version string) string {
+		var spec = project
+		if version != "" {
+			spec += "==" + version
 		}
+		return fmt.Sprintf("pip install --extra-index-url %s/simple/ %s", r.baseURL(req), spec)
 	}
-	fmt.Fprintf(w, "</body></html>")
+	var data = projectPage(project, assets, r.syncer.Releases(), r.syncer.Readme(a.Owner+"/"+a.Repo), "/", r.assetLink, install, r.stylesheet())
+	r.writePage(w, req, func(w io.Writer) error {
+		return r.pages.writeProjectPage(w, data)
+	})
 }
 
 func (r *Router) handleFetchAsset(w http.ResponseWriter, req *http.Request) {
 	var vars map[string]string
 	vars = mux.Vars(req)
-	var owner = strings.ToLower(vars["owner"])
-	var repo = strings.ToLower(vars["repo"])
-	var asset = vars["asset"]
-
-	for _, a := range r.assets {
-		if strings.ToLower(a.Owner) == owner && strings.ToLower(a.Repo) == repo && a.Name == asset {
-			var rc io.ReadCloser
-			var err error
-			rc, err = a.Download(r.client)
-			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			io.Copy(w, rc)
-			return
-		}
+
+	var a, ok = r.findAsset(req, vars["owner"], vars["repo"], vars["asset"])
+	if !ok && strings.HasSuffix(vars["asset"], ".metadata") {
+		r.serveCoreMetadata(w, req, vars["owner"], vars["repo"], strings.TrimSuffix(vars["asset"], ".metadata"))
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
-}
+	r.metrics.inFlight.Inc()
+	defer r.metrics.inFlight.Dec()
 
-func (r *Router) logRequests(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		log.Println(req.Method, req.URL.Path)
-		h.ServeHTTP(w, req)
-	})
+	var cw = &countingWriter{ResponseWriter: w}
+	// cache is only set for redirects, proxied downloads don't use the redirect cache
+	var cache string
+	// Rewritten tag archives only exist here, so they can't be redirected to
+	if r.config.RepoDelivery(a.Owner+"/"+a.Repo) == DeliveryRedirect && !a.rewritten() {
+		cache = "miss"
+		if r.redirectAsset(cw, req, a) {
+			cache = "hit"
+		}
+	} else {
+		r.proxyAsset(cw, req, a)
+	}
+
+	if req.Method == "GET" {
+		if cache != "" {
+			r.metrics.cache.WithLabelValues(cache).Inc()
+		}
+		r.audit(req, a, cw, cache)
+	}
 }
 
 func (r *Router) Handler() http.Handler {
@@ -162,8 +258,19 @@ func (r *Router) Handler() http.Handler {
 
 	// Static favicon
 	h.HandleFunc("/favicon.ico", r.handleFavicon).Methods("GET")
+	if r.pages.HasStylesheet() {
+		h.HandleFunc("/"+stylesheetPath, r.handleStylesheet).Methods("GET")
+	}
+
+	// Health checks and sync status
+	h.HandleFunc("/healthz", r.handleHealthz).Methods("GET")
+	h.HandleFunc("/readyz", r.handleReadyz).Methods("GET")
+	h.HandleFunc("/status", r.handleStatus).Methods("GET")
+	if r.config.MetricsBind == "" {
+		h.HandleFunc("/metrics", r.handleMetrics).Methods("GET")
+	}
 
-	// All links, useful for non-owner/repo specific --find-links
+	// Project list, also usable with --find-links for every project
 	h.HandleFunc("/", r.handleIndex).Methods("GET")
 
 	// Simple index
@@ -172,19 +279,115 @@ func (r *Router) Handler() http.Handler {
 	h.HandleFunc("/simple/{repo}", r.handleSimpleProject).Methods("GET")
 	h.HandleFunc("/simple/{repo}/", r.handleSimpleProject).Methods("GET")
 
-	// Owner/repo specific find-links
+	// PyPI JSON API
+	h.HandleFunc("/pypi/{project}/json", r.handlePyPIProject).Methods("GET")
+	h.HandleFunc("/pypi/{project}/{version}/json", r.handlePyPIProject).Methods("GET")
+
+	// Admin
+	if r.config.adminToken != nil {
+		h.HandleFunc("/admin/refresh", r.requireAdmin(r.handleAdminRefresh)).Methods("POST")
+		if r.tokens != nil {
+			h.HandleFunc("/admin/tokens", r.requireAdmin(r.handleAdminListTokens)).Methods("GET")
+			h.HandleFunc("/admin/tokens", r.requireAdmin(r.handleAdminCreateToken)).Methods("POST")
+			h.HandleFunc("/admin/tokens/{name}", r.requireAdmin(r.handleAdminDeleteToken)).Methods("DELETE")
+		}
+	}
+
+	// Owner project lists and project pages, also usable with --find-links
 	h.HandleFunc("/{owner}", r.handleOwnerIndex).Methods("GET")
 	h.HandleFunc("/{owner}/", r.handleOwnerIndex).Methods("GET")
 	h.HandleFunc("/{owner}/{repo}", r.handleRepoIndex).Methods("GET")
 	h.HandleFunc("/{owner}/{repo}/", r.handleRepoIndex).Methods("GET")
 
 	// Download asset
-	h.HandleFunc("/{owner}/{repo}/{asset}", r.handleFetchAsset).Methods("GET")
-	return r.logRequests(h)
+	h.HandleFunc("/{owner}/{repo}/{asset}", r.handleFetchAsset).Methods("GET", "HEAD")
+	return r.requestID(r.traceRequests(h, r.logRequests(r.instrument(h, r.authenticate(h)))))
+}
+
+func (r *Router) newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: r.config.ReadTimeout,
+		ReadTimeout:       r.config.ReadTimeout,
+		WriteTimeout:      r.config.WriteTimeout,
+		IdleTimeout:       r.config.IdleTimeout,
+	}
 }
 
+// Start serves requests until the process receives SIGINT or SIGTERM, at which
+// point in-flight requests are given up to the shutdown timeout to finish
 func (r *Router) Start() error {
-	r.refetchAssets()
-	http.Handle("/", r.Handler())
-	return http.ListenAndServe(r.config.Bind, nil)
+	var server = r.newServer(r.config.Bind, r.Handler())
+	var servers = []*http.Server{server}
+	var errs = make(chan error, 3)
+
+	if r.config.TLSCert != "" {
+		var err error
+		server.TLSConfig, err = r.tlsConfig()
+		if err != nil {
+			return err
+		}
+		go func() {
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+
+		if r.config.HTTPRedirectBind != "" {
+			var redirect = r.newServer(r.config.HTTPRedirectBind, r.requestID(r.logRequests(http.HandlerFunc(r.redirectToHTTPS))))
+			servers = append(servers, redirect)
+			slog.Info("redirecting plain HTTP to HTTPS", "bind", r.config.HTTPRedirectBind)
+			go func() {
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+	} else {
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+
+	if r.config.MetricsBind != "" {
+		var metrics = r.newServer(r.config.MetricsBind, http.HandlerFunc(r.handleMetrics))
+		servers = append(servers, metrics)
+		slog.Info("serving metrics", "bind", r.config.MetricsBind)
+		go func() {
+			errs <- metrics.ListenAndServe()
+		}()
+	}
+
+	defer ShutdownTracing()
+
+	// Serve while the initial sync runs, /readyz reports when it has finished
+	go r.syncer.SyncAll()
+	defer r.syncer.Stop()
+
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+	case sig := <-signals:
+		slog.Info("waiting for in-flight requests", "signal", sig.String(), "timeout", r.config.ShutdownTimeout.String())
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), r.config.ShutdownTimeout)
+	defer cancel()
+	var err error
+	for _, s := range servers {
+		if serr := s.Shutdown(ctx); serr != nil {
+			// Drop whatever is still in flight
+			s.Close()
+			err = serr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("server stopped")
+	return nil
 }
@@ -0,0 +1,202 @@
+package pypihub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// secretFileCheckInterval is how often secret files are checked for changes
+	secretFileCheckInterval = time.Second
+	// secretCommandTimeout is how long a credential command may run for
+	secretCommandTimeout = 30 * time.Second
+)
+
+// secret is a credential which is looked up whenever it is used, so it can
+// be rotated without restarting pypihub
+type secret interface {
+	Value() (string, error)
+}
+
+type staticSecret string
+
+func (s staticSecret) Value() (string, error) {
+	return string(s), nil
+}
+
+// fileSecret reads a secret from a file, rereading it whenever the file changes
+type fileSecret struct {
+	path string
+
+	mu        sync.Mutex
+	value     string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+func newFileSecret(path string) (*fileSecret, error) {
+	var s = &fileSecret{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load must be called with s.mu held, or before s is shared
+func (s *fileSecret) load() error {
+	var info, err = os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.lastCheck = time.Now()
+	if !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+		var data []byte
+		data, err = ioutil.ReadFile(s.path)
+		if err != nil {
+			return err
+		}
+		var value = strings.TrimSpace(string(data))
+		if value == "" {
+			return fmt.Errorf("%s is empty", s.path)
+		}
+		s.value = value
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+	return nil
+}
+
+func (s *fileSecret) Value() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastCheck) >= secretFileCheckInterval {
+		// Keep using the previous value if e.g. we caught the file halfway through being replaced
+		if err := s.load(); err != nil {
+			slog.Error("error reloading secret", "path", s.path, "error", err)
+		}
+	}
+	return s.value, nil
+}
+
+// commandSecret runs an external command, e.g. 'gh auth token', and uses its
+// output as the secret, caching it for ttl
+type commandSecret struct {
+	command string
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func newCommandSecret(command string, ttl time.Duration) (*commandSecret, error) {
+	var s = &commandSecret{command: command, ttl: ttl}
+	if _, err := s.Value(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *commandSecret) run() (string, error) {
+	var ctx, cancel = context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	var cmd = exec.CommandContext(ctx, "/bin/sh", "-c", s.command)
+	cmd.Stderr = &stderr
+	var out, err = cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running %q: %s: %s", s.command, err, strings.TrimSpace(stderr.String()))
+	}
+	var value = strings.TrimSpace(string(out))
+	if value == "" {
+		return "", fmt.Errorf("running %q: no output", s.command)
+	}
+	return value, nil
+}
+
+func (s *commandSecret) Value() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.value != "" && time.Now().Before(s.expires) {
+		return s.value, nil
+	}
+
+	var value, err = s.run()
+	if err != nil {
+		if s.value == "" {
+			return "", err
+		}
+		// Keep using the expired value rather than failing every request
+		// while e.g. the vault is briefly unreachable
+		slog.Error("error refreshing secret", "error", err)
+		return s.value, nil
+	}
+	s.value = value
+	s.expires = time.Now().Add(s.ttl)
+	return s.value, nil
+}
+
+// newSecret returns the secret given by exactly one of a flag value, a file or a
+// command, named by flag in errors; it returns nil when none of them are set
+func newSecret(flag string, value string, file string, command string, ttl time.Duration) (secret, error) {
+	var given = 0
+	for _, v := range []string{value, file, command} {
+		if v != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, fmt.Errorf("only one of --%s, --%s-file and --%s-command may be given", flag, flag, flag)
+	}
+
+	switch {
+	case file != "":
+		var s, err = newFileSecret(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading --%s-file: %s", flag, err)
+		}
+		return s, nil
+	case command != "":
+		var s, err = newCommandSecret(command, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("--%s-command: %s", flag, err)
+		}
+		return s, nil
+	case value != "":
+		return staticSecret(value), nil
+	default:
+		return nil, nil
+	}
+}
+
+// basicAuthTransport authenticates requests with a username and a password
+// looked up for every request
+type basicAuthTransport struct {
+	Username string
+	Password secret
+	next     http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var password, err = t.Password.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	var clone = cloneRequest(req)
+	clone.SetBasicAuth(t.Username, password)
+	return t.next.RoundTrip(clone)
+}
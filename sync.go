@@ -0,0 +1,384 @@
+package pypihub
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type SyncResult struct {
+	Repo     string    `json:"repo"`
+	Assets   int       `json:"assets"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_seconds"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type repoSync struct {
+	name        string
+	interval    time.Duration
+	assets      []Asset
+	releases    []Release
+	readme      string
+	timer       *time.Timer
+	last        *SyncResult
+	lastSuccess time.Time
+	syncs       int
+	failures    int
+
+	// published counts the snapshots published, so filling in their metadata
+	// can tell whether a newer one replaced the one it read
+	published int
+	filling   bool
+}
+
+type RepoStatus struct {
+	Repo        string     `json:"repo"`
+	Interval    float64    `json:"interval_seconds"`
+	Assets      int        `json:"assets"`
+	LastSync    *time.Time `json:"last_sync"`
+	LastSuccess *time.Time `json:"last_success"`
+	Duration    float64    `json:"duration_seconds"`
+	LastError   string     `json:"last_error,omitempty"`
+	Syncs       int        `json:"syncs"`
+	Failures    int        `json:"failures"`
+}
+
+// syncer keeps the assets of every configured repo up to date, each repo on
+// its own schedule, making sure only one sync talks to GitHub at a time
+type syncer struct {
+	config   Config
+	client   *Client
+	metadata *metadataStore
+
+	// syncMu is held for the duration of a sync
+	syncMu sync.Mutex
+	// ctx is cancelled by Stop, which waits for running syncs with wg
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.RWMutex
+	repos    map[string]*repoSync
+	order    []string
+	assets   []Asset
+	releases []Release
+	stopped  bool
+}
+
+func newSyncer(config Config, client *Client) *syncer {
+	var ctx, cancel = context.WithCancel(context.Background())
+	var s = &syncer{
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   config,
+		client:   client,
+		repos:    make(map[string]*repoSync),
+		order:    make([]string, 0),
+		assets:   make([]Asset, 0),
+		releases: make([]Release, 0),
+	}
+	if !config.NoMetadata {
+		s.metadata = newMetadataStore(client)
+	}
+	for _, name := range config.RepoNames {
+		var key = config.repoKey(name)
+		if _, ok := s.repos[key]; ok {
+			continue
+		}
+		s.repos[key] = &repoSync{
+			name:     name,
+			interval: config.RepoInterval(name),
+			assets:   make([]Asset, 0),
+		}
+		s.order = append(s.order, key)
+	}
+	return s
+}
+
+// Assets returns the current snapshot of assets for all repos
+func (s *syncer) Assets() []Asset {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.assets
+}
+
+// Releases returns the current snapshot of releases for all repos
+func (s *syncer) Releases() []Release {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.releases
+}
+
+// Readme returns the rendered README of the repo r, or "" if it has none
+func (s *syncer) Readme(r string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if rs, ok := s.repos[s.config.repoKey(r)]; ok {
+		return rs.readme
+	}
+	return ""
+}
+
+// HasRepo reports whether the repo r is configured
+func (s *syncer) HasRepo(r string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var _, ok = s.repos[s.config.repoKey(r)]
+	return ok
+}
+
+func (s *syncer) nextDelay(interval time.Duration) time.Duration {
+	if s.config.RefreshJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(s.config.RefreshJitter)))
+}
+
+func (s *syncer) schedule(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	var rs = s.repos[key]
+	if rs.timer != nil {
+		rs.timer.Stop()
+	}
+	rs.timer = time.AfterFunc(s.nextDelay(rs.interval), func() {
+		s.SyncRepo(key)
+	})
+}
+
+// rebuild must be called with s.mu held
+func (s *syncer) rebuild() {
+	var assets = make([]Asset, 0)
+	var releases = make([]Release, 0)
+	for _, key := range s.order {
+		assets = append(assets, s.repos[key].assets...)
+		releases = append(releases, s.repos[key].releases...)
+	}
+	s.assets = assets
+	s.releases = releases
+}
+
+// syncRepo must be called with s.syncMu held
+func (s *syncer) syncRepo(key string) SyncResult {
+	s.mu.RLock()
+	var rs = s.repos[key]
+	s.mu.RUnlock()
+
+	var result = SyncResult{
+		Repo:    key,
+		Started: time.Now(),
+	}
+	var ctx, span = startSpan(s.ctx, "sync "+key, trace.SpanKindInternal, attribute.String("repo", key))
+	var snapshot, err = s.client.GetRepo(ctx, rs.name)
+	// Metadata we don't know yet is read once the snapshot is published, as
+	// that may download every archive
+	var pending bool
+	if err == nil && s.metadata != nil {
+		pending = s.metadata.known(key, snapshot.Assets)
+	}
+	if err == nil {
+		s.client.setArchiveSums(snapshot.Assets)
+		s.client.pruneArchives(rs.name, snapshot.Assets)
+	}
+	result.Duration = time.Since(result.Started).Seconds()
+	recordError(span, err)
+	span.SetAttributes(attribute.Int("assets", len(snapshot.Assets)))
+	span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		// Stopped halfway, which says nothing about the repo
+		result.Error = "sync stopped"
+		result.Assets = len(rs.assets)
+		return result
+	}
+	rs.syncs++
+	if err != nil {
+		rs.failures++
+		// Keep serving the previous assets until a sync succeeds
+		slog.Error("error refetching assets", "repo", key, "error", err)
+		result.Error = err.Error()
+		result.Assets = len(rs.assets)
+		rs.last = &result
+		return result
+	}
+
+	rs.assets = snapshot.Assets
+	rs.releases = snapshot.Releases
+	rs.readme = snapshot.Readme
+	rs.lastSuccess = time.Now()
+	rs.published++
+	s.rebuild()
+	if pending && !rs.filling && !s.stopped {
+		rs.filling = true
+		s.wg.Add(1)
+		go s.fillMetadata(key)
+	}
+
+	result.Assets = len(snapshot.Assets)
+	rs.last = &result
+	return result
+}
+
+// fillMetadata reads the metadata of the published assets of the repo key in
+// the background, publishing them again once it is done
+func (s *syncer) fillMetadata(key string) {
+	defer s.wg.Done()
+
+	s.mu.RLock()
+	var rs = s.repos[key]
+	s.mu.RUnlock()
+	for {
+		s.mu.RLock()
+		var published = rs.published
+		// The published assets are shared with readers, so fill in a copy
+		var assets = append([]Asset(nil), rs.assets...)
+		s.mu.RUnlock()
+
+		var ctx, span = startSpan(s.ctx, "metadata "+key, trace.SpanKindInternal, attribute.String("repo", key))
+		s.metadata.fill(ctx, key, assets)
+		// Rewritten archives read for their metadata are cached now, with their hashes
+		s.client.setArchiveSums(assets)
+		span.End()
+
+		s.mu.Lock()
+		if s.ctx.Err() != nil || rs.published == published {
+			if s.ctx.Err() == nil {
+				rs.assets = assets
+				s.rebuild()
+			}
+			rs.filling = false
+			s.mu.Unlock()
+			return
+		}
+		// A newer snapshot was published meanwhile, fill that one in too
+		s.mu.Unlock()
+	}
+}
+
+// LastSuccess returns the repo whose last successful sync is the oldest and
+// when that was, the time being zero for a repo which hasn't synced successfully yet
+func (s *syncer) LastSuccess() (string, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var repo string
+	var oldest time.Time
+	for i, key := range s.order {
+		var last = s.repos[key].lastSuccess
+		if i == 0 || last.Before(oldest) {
+			repo, oldest = key, last
+		}
+	}
+	return repo, oldest
+}
+
+// Status returns the sync status of every configured repo
+func (s *syncer) Status() []RepoStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var statuses = make([]RepoStatus, 0, len(s.order))
+	for _, key := range s.order {
+		var rs = s.repos[key]
+		var status = RepoStatus{
+			Repo:     key,
+			Interval: rs.interval.Seconds(),
+			Assets:   len(rs.assets),
+			Syncs:    rs.syncs,
+			Failures: rs.failures,
+		}
+		if rs.last != nil {
+			var started = rs.last.Started
+			status.LastSync = &started
+			status.Duration = rs.last.Duration
+			status.LastError = rs.last.Error
+		}
+		if !rs.lastSuccess.IsZero() {
+			var success = rs.lastSuccess
+			status.LastSuccess = &success
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// begin registers a sync with Stop, it returns false once the syncer is stopped
+func (s *syncer) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// SyncRepo refetches the assets of a single repo and reschedules its next sync
+func (s *syncer) SyncRepo(r string) SyncResult {
+	var key = s.config.repoKey(r)
+	if !s.HasRepo(key) {
+		return SyncResult{Repo: key, Started: time.Now(), Error: "unknown repo"}
+	}
+	if !s.begin() {
+		return SyncResult{Repo: key, Started: time.Now(), Error: "sync stopped"}
+	}
+	defer s.wg.Done()
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	var result = s.syncRepo(key)
+	slog.Info("found assets", "repo", key, "assets", result.Assets)
+	s.schedule(key)
+	return result
+}
+
+// SyncAll refetches the assets of every repo and reschedules their next syncs
+func (s *syncer) SyncAll() []SyncResult {
+	var results = make([]SyncResult, 0, len(s.order))
+	if !s.begin() {
+		return results
+	}
+	defer s.wg.Done()
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	slog.Info("refetching assets", "repos", len(s.order))
+	for _, key := range s.order {
+		if s.ctx.Err() != nil {
+			break
+		}
+		results = append(results, s.syncRepo(key))
+		s.schedule(key)
+	}
+	slog.Info("found assets", "assets", len(s.Assets()), "repos", len(s.order))
+	return results
+}
+
+// Stop cancels all scheduled and running syncs, and waits for the running ones to return
+func (s *syncer) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for _, rs := range s.repos {
+		if rs.timer != nil {
+			rs.timer.Stop()
+		}
+	}
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+}
@@ -0,0 +1,271 @@
+package pypihub
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// stylesheetPath is where a custom stylesheet is served from, relative to the root
+const stylesheetPath = "static/style.css"
+
+// defaultTemplates are used for every page without a custom template, the
+// simple pages follow PEP 503 and PEP 629
+var defaultTemplates = map[string]string{
+	"simple-index.html": `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="pypi:repository-version" content="1.0">
+    <title>{{.Title}}</title>
+    {{- if .Stylesheet}}
+    <link rel="stylesheet" href="{{.Stylesheet}}">
+    {{- end}}
+  </head>
+  <body>
+    {{- range .Links}}
+    <a href="{{.URL}}">{{.Name}}</a><br>
+    {{- end}}
+  </body>
+</html>
+`,
+	"simple-project.html": `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="pypi:repository-version" content="1.0">
+    <title>{{.Title}}</title>
+    {{- if .Stylesheet}}
+    <link rel="stylesheet" href="{{.Stylesheet}}">
+    {{- end}}
+  </head>
+  <body>
+    <h1>{{.Heading}}</h1>
+    {{- range .Links}}
+    <a href="{{.URL}}"{{if .Yanked}} data-yanked="{{.YankedReason}}"{{end}}{{if .RequiresPython}} data-requires-python="{{.RequiresPython}}"{{end}}{{if .CoreMetadata}} data-dist-info-metadata="{{.CoreMetadata}}" data-core-metadata="{{.CoreMetadata}}"{{end}}>{{.Name}}</a><br>
+    {{- end}}
+  </body>
+</html>
+`,
+	"projects.html": `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Title}}</title>` + uiStyle + `
+    {{- if .Stylesheet}}
+    <link rel="stylesheet" href="{{.Stylesheet}}">
+    {{- end}}
+  </head>
+  <body>
+    <header><a href="{{.Root}}">pypihub</a></header>
+    <h1>{{.Heading}}</h1>
+    {{- if .Search}}
+    <form method="get">
+      <input type="search" name="q" value="{{.Query}}" placeholder="Search projects">
+      <button type="submit">Search</button>
+    </form>
+    {{- end}}
+    {{- if .Projects}}
+    <table>
+      <thead><tr><th>Project</th><th>Repo</th><th>Latest version</th><th>Released</th><th>Files</th></tr></thead>
+      <tbody>
+      {{- range .Projects}}
+        <tr>
+          <td><a href="{{.URL}}">{{.Name}}</a>{{if .Summary}}<br><span class="muted">{{.Summary}}</span>{{end}}</td>
+          <td class="muted">{{.Owner}}/{{.Repo}}</td>
+          <td>{{.Latest}}</td>
+          <td>{{.Updated}}</td>
+          <td>{{.Files}}</td>
+        </tr>
+      {{- end}}
+      </tbody>
+    </table>
+    {{- else}}
+    <p class="muted">No projects found.</p>
+    {{- end}}
+    {{- if .Links}}
+    <details>
+      <summary>All files</summary>
+      <ul>
+      {{- range .Links}}
+        <li><a href="{{.URL}}"{{if .Yanked}} data-yanked="{{.YankedReason}}"{{end}}{{if .RequiresPython}} data-requires-python="{{.RequiresPython}}"{{end}}{{if .CoreMetadata}} data-dist-info-metadata="{{.CoreMetadata}}" data-core-metadata="{{.CoreMetadata}}"{{end}}>{{.Name}}</a></li>
+      {{- end}}
+      </ul>
+    </details>
+    {{- end}}
+  </body>
+</html>
+`,
+	"project.html": `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Title}}</title>` + uiStyle + `
+    {{- if .Stylesheet}}
+    <link rel="stylesheet" href="{{.Stylesheet}}">
+    {{- end}}
+  </head>
+  <body>
+    <header><a href="{{.Root}}">pypihub</a> / <a href="{{.Root}}{{.Owner}}/">{{.Owner}}</a></header>
+    <h1>{{.Heading}}</h1>
+    {{- if .Summary}}
+    <p>{{.Summary}}</p>
+    {{- end}}
+    <p class="muted"><a href="{{.GitHubURL}}">{{.Owner}}/{{.Repo}}</a> on GitHub</p>
+    {{- if .Install}}
+    <pre><code>{{.Install}}</code></pre>
+    {{- end}}
+    {{- if .Releases}}
+    <h2>Versions</h2>
+    <ul>
+    {{- range .Releases}}
+      <li><a href="#{{.Version}}">{{.Version}}</a>{{if .Published}} <span class="muted">{{.Published}}</span>{{end}}{{if .Yanked}} <span class="yanked">yanked</span>{{end}}</li>
+    {{- end}}
+    </ul>
+    {{- end}}
+    {{- if .Readme}}
+    <h2>README</h2>
+    <div class="readme">{{.Readme}}</div>
+    {{- end}}
+    {{- range .Releases}}
+    <section class="release" id="{{.Version}}">
+      <h2>{{.Version}}</h2>
+      <p class="muted">{{if .Published}}Released {{.Published}} from{{else}}Tag{{end}} <code>{{.Tag}}</code></p>
+      {{- if .Yanked}}
+      <p class="yanked">Yanked{{if .YankedReason}}: {{.YankedReason}}{{end}}</p>
+      {{- end}}
+      {{- if .Install}}
+      <pre><code>{{.Install}}</code></pre>
+      {{- end}}
+      {{- if .Notes}}
+      <div class="notes">{{.Notes}}</div>
+      {{- end}}
+      <table>
+        <thead><tr><th>File</th><th>Size</th><th>SHA256</th></tr></thead>
+        <tbody>
+        {{- range .Files}}
+          <tr>
+            <td><a href="{{.URL}}"{{if .Yanked}} data-yanked="{{.YankedReason}}"{{end}}{{if .RequiresPython}} data-requires-python="{{.RequiresPython}}"{{end}}{{if .CoreMetadata}} data-dist-info-metadata="{{.CoreMetadata}}" data-core-metadata="{{.CoreMetadata}}"{{end}}>{{.Name}}</a></td>
+            <td>{{.Size}}</td>
+            <td class="hash">{{if .SHA256}}<code>{{.SHA256}}</code>{{end}}</td>
+          </tr>
+        {{- end}}
+        </tbody>
+      </table>
+    </section>
+    {{- end}}
+  </body>
+</html>
+`,
+}
+
+// uiStyle is the look of the project list and project pages, a custom
+// stylesheet is linked after it so it can override any of it
+const uiStyle = `
+    <style>
+      body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; line-height: 1.5; color: #24292f; max-width: 960px; margin: 0 auto; padding: 0 1rem 2rem; }
+      header { border-bottom: 1px solid #d0d7de; padding: 1rem 0; margin-bottom: 1rem; }
+      header a { color: inherit; font-weight: bold; text-decoration: none; }
+      a { color: #0969da; }
+      pre { background: #f6f8fa; padding: 0.75rem; overflow-x: auto; border-radius: 6px; }
+      code { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: 0.9em; }
+      table { border-collapse: collapse; width: 100%; margin: 0.5rem 0 1rem; }
+      th, td { text-align: left; padding: 0.3rem 0.5rem; border-bottom: 1px solid #d0d7de; vertical-align: top; }
+      td.hash code { word-break: break-all; font-size: 0.75em; }
+      input[type=search] { width: 70%; padding: 0.4rem; }
+      .muted { color: #57606a; }
+      .yanked { color: #cf222e; }
+      .release { border-top: 1px solid #d0d7de; margin-top: 1.5rem; }
+      .readme { border: 1px solid #d0d7de; border-radius: 6px; padding: 0 1rem; margin: 1rem 0; }
+      .readme img { max-width: 100%; }
+    </style>`
+
+// pageLink is a single link rendered on a page
+type pageLink struct {
+	Name string
+	URL  string
+
+	// Yanked and YankedReason are only set for links to yanked assets
+	Yanked       bool
+	YankedReason string
+
+	// RequiresPython and CoreMetadata are only set for assets we read the
+	// metadata of, CoreMetadata is the hash of its .metadata file e.g. 'sha256=<hex>'
+	RequiresPython string
+	CoreMetadata   string
+}
+
+// pageData is what every page template is executed with
+type pageData struct {
+	Title      string
+	Heading    string
+	Project    string
+	Stylesheet string
+	Links      []pageLink
+
+	// Used by the project list and project pages only
+	Root      string // the link to the project list of every repo, ending in '/'
+	Search    bool   // whether the project list can be searched with ?q=
+	Query     string
+	Projects  []projectSummary
+	Owner     string
+	Repo      string
+	Summary   string
+	GitHubURL string
+	Install   string
+	Readme    template.HTML
+	Releases  []pageRelease
+}
+
+// pageTemplates renders the HTML pages, using templates from a user supplied
+// directory where present and the default templates otherwise
+type pageTemplates struct {
+	templates map[string]*template.Template
+	css       []byte
+}
+
+func loadPageTemplates(dir string) (*pageTemplates, error) {
+	var p = &pageTemplates{
+		templates: make(map[string]*template.Template),
+	}
+	for name, text := range defaultTemplates {
+		if dir != "" {
+			var data, err = ioutil.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				text = string(data)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		var t, err = template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %s", name, err)
+		}
+		p.templates[name] = t
+	}
+
+	if dir != "" {
+		var css, err = ioutil.ReadFile(filepath.Join(dir, "style.css"))
+		if err == nil {
+			p.css = css
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// HasStylesheet reports whether a custom stylesheet was supplied
+func (p *pageTemplates) HasStylesheet() bool {
+	return p.css != nil
+}
+
+func (p *pageTemplates) render(w io.Writer, name string, data pageData) error {
+	return p.templates[name].Execute(w, data)
+}
@@ -0,0 +1,190 @@
+package pypihub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often we look for changes to the certificate and key files
+const certCheckInterval = time.Second
+
+// certReloader serves the certificate from a cert and key file, reloading
+// them whenever either file changes so certificates can be renewed without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	var c = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	var modTimes, err = c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.load(modTimes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, f := range []string{c.certFile, c.keyFile} {
+		var info, err = os.Stat(f)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load must be called with c.mu held, or before c is shared
+func (c *certReloader) load(modTimes [2]time.Time) error {
+	var cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTimes = modTimes
+	return nil
+}
+
+func (c *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.lastCheck = time.Now()
+
+	var modTimes, err = c.stat()
+	if err != nil {
+		slog.Error("error checking TLS certificate", "path", c.certFile, "error", err)
+		return c.cert, nil
+	}
+	if modTimes == c.modTimes {
+		return c.cert, nil
+	}
+
+	// Keep serving the previous certificate if e.g. we caught the cert
+	// and key files halfway through being replaced
+	if err = c.load(modTimes); err != nil {
+		slog.Error("error reloading TLS certificate", "path", c.certFile, "error", err)
+		return c.cert, nil
+	}
+	slog.Info("reloaded TLS certificate", "path", c.certFile)
+	return c.cert, nil
+}
+
+func (r *Router) tlsConfig() (*tls.Config, error) {
+	var reloader, err = newCertReloader(r.config.TLSCert, r.config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %s", err)
+	}
+
+	var cfg = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if r.config.TLSClientCA != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(r.config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client CA: %s", err)
+		}
+		var pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("loading TLS client CA: no certificates found in %s", r.config.TLSClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.config.TLSRequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// clientCertAuthenticator identifies clients by the subject of their
+// verified TLS client certificate
+type clientCertAuthenticator struct {
+	rules []grantRule
+}
+
+func newClientCertAuthenticator(config Config) (*clientCertAuthenticator, error) {
+	var c = &clientCertAuthenticator{}
+	for _, s := range config.TLSClientRules {
+		var rule, err = parseGrantRule(s)
+		if err != nil {
+			return nil, err
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return c, nil
+}
+
+func certClaims(cert *x509.Certificate) map[string]interface{} {
+	var claims = map[string]interface{}{
+		"subject": cert.Subject.String(),
+		"cn":      cert.Subject.CommonName,
+		"o":       strings.Join(cert.Subject.Organization, " "),
+		"ou":      strings.Join(cert.Subject.OrganizationalUnit, " "),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		claims["email"] = cert.EmailAddresses[0]
+	}
+	return claims
+}
+
+func (c *clientCertAuthenticator) Authenticate(req *http.Request) *Identity {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	var cert = req.TLS.VerifiedChains[0][0]
+	var id = &Identity{
+		Name:   cert.Subject.String(),
+		Method: "mtls",
+	}
+	// Without any rules every trusted certificate may read everything
+	if len(c.rules) > 0 {
+		id.Grants = grantsFor(c.rules, certClaims(cert))
+	}
+	return id
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the same URL on the HTTPS listener
+func (r *Router) redirectToHTTPS(w http.ResponseWriter, req *http.Request) {
+	var host = req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(r.config.Bind); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	var u = *req.URL
+	u.Scheme = "https"
+	u.Host = host
+	http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+}
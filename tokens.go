@@ -0,0 +1,241 @@
+package pypihub
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Token is an API token which may read the assets matching its grants
+type Token struct {
+	Name string `json:"name"`
+	// Token is the plain text secret, only used when loading tokens from a file
+	Token string `json:"token,omitempty"`
+	// SHA256 is the hex encoded sha256 of the secret, tokens created through
+	// the admin API are only ever stored this way
+	SHA256 string  `json:"token_sha256,omitempty"`
+	Grants []Grant `json:"grants"`
+}
+
+func hashToken(secret string) string {
+	var sum = sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateGrants(grants []Grant) error {
+	for _, g := range grants {
+		if _, err := path.Match(strings.TrimPrefix(string(g), "project:"), ""); err != nil {
+			return fmt.Errorf("invalid grant %q: %s", g, err)
+		}
+	}
+	return nil
+}
+
+// tokenStore holds the API tokens, optionally persisting them to a JSON file
+type tokenStore struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens map[string]Token
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	var s = &tokenStore{
+		path:   path,
+		tokens: make(map[string]Token),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	var data, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tokens []Token
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parsing tokens file %s: %s", path, err)
+	}
+	for _, t := range tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("parsing tokens file %s: token without a name", path)
+		}
+		if t.Token != "" {
+			t.SHA256 = hashToken(t.Token)
+		}
+		if t.SHA256 == "" {
+			return nil, fmt.Errorf("parsing tokens file %s: token %s has no token or token_sha256", path, t.Name)
+		}
+		if err = validateGrants(t.Grants); err != nil {
+			return nil, fmt.Errorf("parsing tokens file %s: token %s: %s", path, t.Name, err)
+		}
+		s.tokens[t.Name] = t
+	}
+	return s, nil
+}
+
+// save must be called with s.mu held
+func (s *tokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	var data, err = json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	var tmp = s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// list must be called with s.mu held
+func (s *tokenStore) list() []Token {
+	var tokens = make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	return tokens
+}
+
+// List returns all tokens, without their secrets
+func (s *tokenStore) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tokens = s.list()
+	for i := range tokens {
+		tokens[i].Token = ""
+		tokens[i].SHA256 = ""
+	}
+	return tokens
+}
+
+// Create generates a new token with the given name and grants, returning its secret
+func (s *tokenStore) Create(name string, grants []Grant) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("token name is required")
+	}
+	if err := validateGrants(grants); err != nil {
+		return "", err
+	}
+
+	var raw = make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	var secret = "pph_" + hex.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[name]; ok {
+		return "", fmt.Errorf("token %s already exists", name)
+	}
+	if grants == nil {
+		grants = make([]Grant, 0)
+	}
+	s.tokens[name] = Token{Name: name, SHA256: hashToken(secret), Grants: grants}
+	if err := s.save(); err != nil {
+		delete(s.tokens, name)
+		return "", err
+	}
+	return secret, nil
+}
+
+// Delete removes the token with the given name, reporting whether it existed
+func (s *tokenStore) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t, ok = s.tokens[name]
+	if !ok {
+		return false, nil
+	}
+	delete(s.tokens, name)
+	if err := s.save(); err != nil {
+		s.tokens[name] = t
+		return false, err
+	}
+	return true, nil
+}
+
+// Authenticate accepts a token either as a bearer token, or as the basic auth password
+func (s *tokenStore) Authenticate(req *http.Request) *Identity {
+	var secret = bearerToken(req)
+	if secret == "" {
+		_, secret, _ = req.BasicAuth()
+	}
+	if secret == "" {
+		return nil
+	}
+	var hash = hashToken(secret)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.SHA256), []byte(hash)) == 1 {
+			var grants = t.Grants
+			if grants == nil {
+				grants = make([]Grant, 0)
+			}
+			return &Identity{Name: t.Name, Method: "token", Grants: grants}
+		}
+	}
+	return nil
+}
+
+func (r *Router) handleAdminListTokens(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]Token{"tokens": r.tokens.List()})
+}
+
+func (r *Router) handleAdminCreateToken(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name   string  `json:"name"`
+		Grants []Grant `json:"grants"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var secret, err = r.tokens.Create(body.Name, body.Grants)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, Token{Name: body.Name, Token: secret, Grants: body.Grants})
+}
+
+func (r *Router) handleAdminDeleteToken(w http.ResponseWriter, req *http.Request) {
+	var name = mux.Vars(req)["name"]
+	var ok, err = r.tokens.Delete(name)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown token " + name})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
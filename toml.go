@@ -0,0 +1,445 @@
+package pypihub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses the subset of TOML found in pyproject.toml files: tables,
+// arrays of tables and key/value pairs with string, number, boolean, array
+// and inline table values. Dates and times are kept as strings.
+func parseTOML(data string) (map[string]interface{}, error) {
+	var p = &tomlParser{s: data, line: 1}
+	var root = make(map[string]interface{})
+	var current = root
+
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return root, nil
+		}
+
+		var err error
+		if p.peek() == '[' {
+			current, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(current)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", p.line, err)
+		}
+
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+			return nil, fmt.Errorf("line %d: unexpected %q", p.line, p.peek())
+		}
+	}
+}
+
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(p.s[p.pos:], prefix)
+}
+
+// skipSpace skips whitespace and comments, and newlines too when newlines is true
+func (p *tomlParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case newlines && (c == '\n' || c == '\r'):
+			if c == '\n' {
+				p.line++
+			}
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) expect(c byte) error {
+	if p.eof() || p.peek() != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// tomlTable returns the table at keys below t, creating any missing tables
+func tomlTable(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		switch v := t[k].(type) {
+		case nil:
+			var next = make(map[string]interface{})
+			t[k] = next
+			t = next
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			// Keys below an array of tables refer to its last table
+			if len(v) == 0 {
+				return nil, fmt.Errorf("%q is an empty array", k)
+			}
+			var last, ok = v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%q is not a table", k)
+			}
+			t = last
+		default:
+			return nil, fmt.Errorf("%q is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+func (p *tomlParser) parseHeader(root map[string]interface{}) (map[string]interface{}, error) {
+	var array = p.hasPrefix("[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+
+	p.skipSpace(false)
+	var keys, err = p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace(false)
+	if array {
+		if !p.hasPrefix("]]") {
+			return nil, fmt.Errorf("expected \"]]\"")
+		}
+		p.pos += 2
+	} else if err = p.expect(']'); err != nil {
+		return nil, err
+	}
+
+	if !array {
+		return tomlTable(root, keys)
+	}
+	var parent map[string]interface{}
+	parent, err = tomlTable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	var last = keys[len(keys)-1]
+	var list, ok = parent[last].([]interface{})
+	if parent[last] != nil && !ok {
+		return nil, fmt.Errorf("%q is not an array of tables", last)
+	}
+	var table = make(map[string]interface{})
+	parent[last] = append(list, table)
+	return table, nil
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys = make([]string, 0, 1)
+	for {
+		if p.eof() {
+			return nil, fmt.Errorf("expected a key")
+		}
+
+		var key string
+		var err error
+		switch p.peek() {
+		case '"':
+			key, err = p.parseBasicString()
+		case '\'':
+			key, err = p.parseLiteralString()
+		default:
+			var start = p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("expected a key, found %q", p.peek())
+			}
+			key = p.s[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		p.skipSpace(false)
+		if p.eof() || p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+		p.skipSpace(false)
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseKeyValue(t map[string]interface{}) error {
+	var keys, err = p.parseKey()
+	if err != nil {
+		return err
+	}
+	if err = p.expect('='); err != nil {
+		return err
+	}
+	p.skipSpace(false)
+
+	var v interface{}
+	if v, err = p.parseValue(); err != nil {
+		return err
+	}
+	if t, err = tomlTable(t, keys[:len(keys)-1]); err != nil {
+		return err
+	}
+	t[keys[len(keys)-1]] = v
+	return nil
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	if p.eof() {
+		return nil, fmt.Errorf("expected a value")
+	}
+
+	switch p.peek() {
+	case '"':
+		if p.hasPrefix(`"""`) {
+			return p.parseMultilineString(`"""`, true)
+		}
+		return p.parseBasicString()
+	case '\'':
+		if p.hasPrefix("'''") {
+			return p.parseMultilineString("'''", false)
+		}
+		return p.parseLiteralString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	var start = p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]}#", rune(p.peek())) {
+		p.pos++
+	}
+	var token = p.s[start:p.pos]
+	switch token {
+	case "":
+		return nil, fmt.Errorf("expected a value, found %q", p.peek())
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(strings.Replace(token, "_", "", -1), 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(strings.Replace(token, "_", "", -1), 64); err == nil {
+		return f, nil
+	}
+	return token, nil
+}
+
+func (p *tomlParser) parseArray() (interface{}, error) {
+	p.pos++
+	var values = make([]interface{}, 0)
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+
+		var v, err = p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		p.skipSpace(true)
+		if !p.eof() && p.peek() == ',' {
+			p.pos++
+		} else if p.eof() || p.peek() != ']' {
+			return nil, fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (interface{}, error) {
+	p.pos++
+	var t = make(map[string]interface{})
+	p.skipSpace(false)
+	if !p.eof() && p.peek() == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		p.skipSpace(false)
+		if err := p.parseKeyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.eof() {
+			return nil, fmt.Errorf("unterminated inline table")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, fmt.Errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	var end = strings.IndexAny(p.s[p.pos:], "'\n")
+	if end < 0 || p.s[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+	var s = p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		var c = p.peek()
+		switch c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+func (p *tomlParser) parseMultilineString(delim string, escapes bool) (string, error) {
+	p.pos += len(delim)
+	// A newline straight after the opening delimiter is trimmed
+	if p.hasPrefix("\r\n") {
+		p.pos += 2
+		p.line++
+	} else if p.hasPrefix("\n") {
+		p.pos++
+		p.line++
+	}
+
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if p.hasPrefix(delim) {
+			p.pos += len(delim)
+			// Up to two quotes may directly precede the closing delimiter
+			for i := 0; i < 2 && !p.eof() && p.peek() == delim[0]; i++ {
+				b.WriteByte(delim[0])
+				p.pos++
+			}
+			return b.String(), nil
+		}
+
+		var c = p.peek()
+		if c == '\n' {
+			p.line++
+		}
+		if escapes && c == '\\' {
+			// A backslash at the end of a line trims all whitespace up to the next non whitespace character
+			var rest = strings.TrimLeft(p.s[p.pos+1:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				p.pos++
+				for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+					if p.peek() == '\n' {
+						p.line++
+					}
+					p.pos++
+				}
+				continue
+			}
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	p.pos++
+	if p.eof() {
+		return fmt.Errorf("unterminated escape")
+	}
+	var c = p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		var n = 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.s) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		var r, err = strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		b.WriteRune(rune(r))
+		p.pos += n
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package pypihub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type table = map[string]interface{}
+
+func TestParseTOML(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		want table
+	}{
+		{
+			name: "empty",
+			data: "",
+			want: table{},
+		},
+		{
+			name: "comments and blank lines",
+			data: "# comment\n\n  # indented comment\n",
+			want: table{},
+		},
+		{
+			name: "values",
+			data: `str = "a \"quoted\" \u00e9 string"
+literal = 'C:\path'
+int = 1_000
+hex = 0x1f
+float = 3.14
+bool = true
+date = 2020-01-02
+`,
+			want: table{
+				"str":     `a "quoted" é string`,
+				"literal": `C:\path`,
+				"int":     int64(1000),
+				"hex":     int64(31),
+				"float":   3.14,
+				"bool":    true,
+				"date":    "2020-01-02",
+			},
+		},
+		{
+			name: "multiline strings",
+			data: "basic = \"\"\"\nline one\nline \\\n    two\"\"\"\nliteral = '''\nraw \\n'''\n",
+			want: table{
+				"basic":   "line one\nline two",
+				"literal": "raw \\n",
+			},
+		},
+		{
+			name: "arrays",
+			data: "deps = [\n  \"a\", # first\n  \"b\",\n]\nempty = []\nnested = [[1, 2], ['x']]\n",
+			want: table{
+				"deps":   []interface{}{"a", "b"},
+				"empty":  []interface{}{},
+				"nested": []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{"x"}},
+			},
+		},
+		{
+			name: "tables and dotted keys",
+			data: "[project]\nname = \"pkg\"\nurls.Homepage = \"https://example.com\"\n\n[\"tool\" . 'pkg']\nkey = 1\n",
+			want: table{
+				"project": table{
+					"name": "pkg",
+					"urls": table{"Homepage": "https://example.com"},
+				},
+				"tool": table{
+					"pkg": table{"key": int64(1)},
+				},
+			},
+		},
+		{
+			name: "inline tables",
+			data: "license = { text = \"MIT\" }\nempty = {}\n",
+			want: table{
+				"license": table{"text": "MIT"},
+				"empty":   table{},
+			},
+		},
+		{
+			name: "arrays of tables",
+			data: "[[project.authors]]\nname = \"a\"\n[[project.authors]]\nname = \"b\"\n[project.authors.extra]\nk = true\n",
+			want: table{
+				"project": table{
+					"authors": []interface{}{
+						table{"name": "a"},
+						table{"name": "b", "extra": table{"k": true}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got, err = parseTOML(test.data)
+			if err != nil {
+				t.Fatalf("parseTOML() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"missing value", "a =\n", "line 1: expected a value"},
+		{"missing equals", "a 1\n", `line 1: expected '='`},
+		{"trailing garbage", "a = 1 2\n", `line 1: unexpected '2'`},
+		{"unterminated string", "a = \"abc\n", "line 1: unterminated string"},
+		{"unterminated literal string", "a = 'abc\n", "line 1: unterminated string"},
+		{"unterminated multiline string", "a = \"\"\"abc\n", "unterminated string"},
+		{"invalid escape", `a = "\x"`, "line 1: invalid escape"},
+		{"invalid unicode escape", `a = "\uzzzz"`, "line 1: invalid unicode escape"},
+		{"unterminated array", "a = [1,\n", "line 2: unterminated array"},
+		{"missing array separator", "a = [1 2]\n", "line 1: expected ',' or ']' in array"},
+		{"unterminated inline table", "a = { b = 1\n", "line 1: expected ',' or '}' in inline table"},
+		{"unterminated header", "[a\n", `line 1: expected ']'`},
+		{"unterminated array header", "[[a]\n", `line 1: expected "]]"`},
+		{"missing key", "[]\n", "line 1: expected a key"},
+		{"value used as table", "a = 1\n[a]\n", `line 2: "a" is not a table`},
+		{"value used as array of tables", "a = 1\n[[a]]\n", `line 2: "a" is not an array of tables`},
+		{"table below empty array", "a = []\n[a.b]\n", `line 2: "a" is an empty array`},
+		{"dotted key below empty array", "a = []\na.b = 1\n", `line 2: "a" is an empty array`},
+		{"table below array of values", "a = [1]\n[a.b]\n", `line 2: "a" is not a table`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got, err = parseTOML(test.data)
+			if err == nil {
+				t.Fatalf("parseTOML() = %#v, want an error", got)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseTOML() error = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
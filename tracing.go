@@ -0,0 +1,193 @@
+package pypihub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceExporterNone disables tracing
+	TraceExporterNone = "none"
+	// TraceExporterOTLP sends spans to an OpenTelemetry collector with OTLP/HTTP
+	TraceExporterOTLP = "otlp"
+	// TraceExporterStdout writes spans to stdout as JSON, for debugging
+	TraceExporterStdout = "stdout"
+)
+
+// traceShutdownTimeout is how long we wait for the last spans to be exported
+const traceShutdownTimeout = 5 * time.Second
+
+// tracerProvider records and exports spans, nil when tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+// startSpan starts a span as a child of the span in ctx, which may be the
+// remote parent of an incoming request, or as the root of a new trace. Spans
+// are no-ops until tracing has been set up.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer("github.com/brettlangdon/pypihub").Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// recordError marks the span as failed with err, if it isn't nil
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// injectTraceparent passes the trace context of the span in ctx on to an outgoing request
+func injectTraceparent(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// cloneRequest returns a copy of req with its own headers, as RoundTrippers
+// must not modify the request they are given
+func cloneRequest(req *http.Request) *http.Request {
+	var clone = new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	return clone
+}
+
+// propagatingTransport passes the ID and trace context of the request being
+// served on to every outgoing request
+type propagatingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *propagatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var clone = cloneRequest(req)
+	if id := RequestID(req.Context()); id != "" {
+		clone.Header.Set("X-Request-ID", id)
+	}
+	injectTraceparent(req.Context(), clone.Header)
+	return t.next.RoundTrip(clone)
+}
+
+// spanBody ends a span once the response body it belongs to is closed
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (b *spanBody) Close() error {
+	var err = b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
+
+// traceRequests starts a server span for every request, continuing the trace
+// of the caller when the request carries a W3C traceparent header
+func (r *Router) traceRequests(routes *mux.Router, next http.Handler) http.Handler {
+	if tracerProvider == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var route = "unmatched"
+		var match mux.RouteMatch
+		if routes.Match(req, &match) {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		var ctx = otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		var span trace.Span
+		ctx, span = startSpan(ctx, req.Method+" "+route, trace.SpanKindServer,
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.HTTPRoute(route),
+			semconv.URLPath(req.URL.Path),
+			semconv.UserAgentOriginal(req.UserAgent()),
+			semconv.ClientAddress(r.clientIP(req)),
+		)
+		defer span.End()
+
+		var cw = &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, req.WithContext(ctx))
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(cw.Status()),
+			semconv.HTTPResponseBodySize(int(cw.bytes)),
+		)
+		if cw.Status() >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("%d %s", cw.Status(), http.StatusText(cw.Status())))
+		}
+	})
+}
+
+// setupTracing starts the configured exporter, spans are only recorded once it has been called
+func setupTracing(config Config) error {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.TraceExporter {
+	case TraceExporterOTLP:
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(config.TraceEndpoint),
+			otlptracehttp.WithHTTPClient(&http.Client{
+				Transport: &propagatingTransport{next: http.DefaultTransport},
+				Timeout:   10 * time.Second,
+			}),
+		)
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("starting the %s trace exporter: %s", config.TraceExporter, err)
+	}
+
+	var res *resource.Resource
+	res, err = resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("pypihub"),
+		semconv.ServiceVersion(VERSION),
+	))
+	if err != nil {
+		return err
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Traces continued from a caller follow the caller's decision
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("tracing error", "error", err)
+	}))
+	return nil
+}
+
+// ShutdownTracing exports any spans which haven't been exported yet, it should be
+// called before exiting
+func ShutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("error exporting the remaining spans", "error", err)
+	}
+}
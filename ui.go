@@ -0,0 +1,312 @@
+package pypihub
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brettlangdon/pypihub/pep440"
+)
+
+// uiDateFormat is how dates are shown on the project pages
+const uiDateFormat = "2006-01-02"
+
+// projectSummary is a single project on the project list pages
+type projectSummary struct {
+	Name    string
+	Owner   string
+	Repo    string
+	URL     string
+	Summary string
+	Latest  string
+	Updated string
+	Files   int
+}
+
+// pageFile is a single downloadable file of a release
+type pageFile struct {
+	Name   string
+	URL    string
+	Size   string
+	SHA256 string
+
+	Yanked       bool
+	YankedReason string
+
+	RequiresPython string
+	CoreMetadata   string
+}
+
+// pageRelease is a single version on a project page
+type pageRelease struct {
+	Version   string
+	Tag       string
+	Published string
+	Notes     template.HTML
+	Install   string
+	Files     []pageFile
+
+	Yanked       bool
+	YankedReason string
+}
+
+// formatSize returns n bytes in a human friendly unit, e.g. '1.5 MB'
+func formatSize(n int) string {
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	var size = float64(n)
+	for _, unit := range []string{"kB", "MB", "GB"} {
+		size /= 1000
+		if size < 1000 {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f TB", size/1000)
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(uiDateFormat)
+}
+
+func repoOf(owner string, repo string) string {
+	return strings.ToLower(owner + "/" + repo)
+}
+
+// sortReleases orders releases newest version first (see pep440.Compare)
+func sortReleases(releases []Release) []Release {
+	var sorted = make([]Release, len(releases))
+	copy(sorted, releases)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return pep440.Compare(sorted[i].Version, sorted[j].Version) > 0
+	})
+	return sorted
+}
+
+// latestRelease returns the newest release which isn't yanked or a pre-release,
+// falling back to the newest release which isn't yanked and then the newest
+func latestRelease(releases []Release) (Release, bool) {
+	var sorted = sortReleases(releases)
+	for _, rel := range sorted {
+		if v, err := pep440.Parse(rel.Version); err == nil && !rel.Yanked && !v.IsPrerelease() {
+			return rel, true
+		}
+	}
+	for _, rel := range sorted {
+		if !rel.Yanked {
+			return rel, true
+		}
+	}
+	if len(sorted) > 0 {
+		return sorted[0], true
+	}
+	return Release{}, false
+}
+
+// projectSummaries returns a summary of every repo with assets in assets,
+// matching query against the project and repo names when it isn't empty
+func projectSummaries(assets []Asset, releases []Release, query string, link func(owner string, repo string, project string) string) []projectSummary {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	// Projects are keyed by repo and name, as monorepos have several
+	var summaries = make([]projectSummary, 0)
+	var index = make(map[string]int)
+	var files = make(map[string][]Asset)
+	for _, a := range assets {
+		var repo = repoOf(a.Owner, a.Repo)
+		var key = repo + "#" + projectName(a)
+		files[key+"@"+a.Version] = append(files[key+"@"+a.Version], a)
+		var i, ok = index[key]
+		if !ok {
+			if query != "" && !strings.Contains(projectName(a), query) && !strings.Contains(repo, query) {
+				continue
+			}
+			i = len(summaries)
+			index[key] = i
+			summaries = append(summaries, projectSummary{
+				Name:  projectName(a),
+				Owner: a.Owner,
+				Repo:  a.Repo,
+				URL:   link(a.Owner, a.Repo, projectName(a)),
+			})
+		}
+		summaries[i].Files++
+	}
+
+	var byProject = make(map[string][]Release)
+	for _, rel := range releases {
+		var key = repoOf(rel.Owner, rel.Repo) + "#" + releaseProjectName(rel)
+		byProject[key] = append(byProject[key], rel)
+	}
+	for key, i := range index {
+		if latest, ok := latestRelease(byProject[key]); ok {
+			summaries[i].Latest = latest.Version
+			summaries[i].Updated = formatDate(latest.Published)
+			if md := releaseMetadata(files[key+"@"+latest.Version]); md != nil {
+				summaries[i].Summary = md.Summary
+			}
+		}
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// projectReleases returns the releases of a single repo newest first, along
+// with the files of each of them found in assets
+func projectReleases(releases []Release, assets []Asset, link assetLinker, install func(version string) string) []pageRelease {
+	var files = make(map[string][]pageFile)
+	for _, a := range assets {
+		var f = pageFile{
+			Name:         a.Name,
+			URL:          link(a),
+			SHA256:       a.SHA256,
+			Yanked:       a.Yanked,
+			YankedReason: a.YankedReason,
+		}
+		if a.Size > 0 {
+			f.Size = formatSize(a.Size)
+		}
+		if a.Metadata != nil {
+			f.RequiresPython = a.Metadata.RequiresPython
+		}
+		if _, sum, ok := coreMetadata(a); ok {
+			f.CoreMetadata = "sha256=" + sum
+		}
+		files[a.Version] = append(files[a.Version], f)
+	}
+
+	var pages = make([]pageRelease, 0, len(releases))
+	for _, rel := range sortReleases(releases) {
+		if len(files[rel.Version]) == 0 {
+			continue
+		}
+		pages = append(pages, pageRelease{
+			Version:   rel.Version,
+			Tag:       rel.Tag,
+			Published: formatDate(rel.Published),
+			// GitHub sanitizes the HTML it renders
+			Notes:        template.HTML(rel.NotesHTML),
+			Install:      install(rel.Version),
+			Files:        files[rel.Version],
+			Yanked:       rel.Yanked,
+			YankedReason: rel.YankedReason,
+		})
+	}
+	return pages
+}
+
+func (p *pageTemplates) writeProjectsPage(w io.Writer, title string, heading string, root string, search bool, query string, projects []projectSummary, assets []Asset, link assetLinker, stylesheet string) error {
+	return p.render(w, "projects.html", pageData{
+		Title:      title,
+		Heading:    heading,
+		Root:       root,
+		Search:     search,
+		Query:      query,
+		Projects:   projects,
+		Stylesheet: stylesheet,
+		Links:      assetLinks(assets, link),
+	})
+}
+
+// projectPage returns the page of project, whose assets all come from a single
+// repo, picking its releases out of releases
+func projectPage(project string, assets []Asset, releases []Release, readme string, root string, link assetLinker, install func(version string) string, stylesheet string) pageData {
+	var a = assets[0]
+	var matching = make([]Release, 0)
+	for _, rel := range releases {
+		if repoOf(rel.Owner, rel.Repo) == repoOf(a.Owner, a.Repo) && releaseProjectName(rel) == project {
+			matching = append(matching, rel)
+		}
+	}
+
+	var data = pageData{
+		Title:      fmt.Sprintf("%s - %s/%s", project, a.Owner, a.Repo),
+		Heading:    project,
+		Project:    project,
+		Stylesheet: stylesheet,
+		Root:       root,
+		Owner:      a.Owner,
+		Repo:       a.Repo,
+		GitHubURL:  fmt.Sprintf("https://github.com/%s/%s", a.Owner, a.Repo),
+		Install:    install(""),
+		// GitHub sanitizes the HTML it renders
+		Readme:   template.HTML(readme),
+		Releases: projectReleases(matching, assets, link, install),
+		Links:    assetLinks(assets, link),
+	}
+	if latest, ok := latestRelease(matching); ok {
+		if md := releaseMetadata(filterAssets(assets, func(a Asset) bool { return a.Version == latest.Version })); md != nil {
+			data.Summary = md.Summary
+		}
+	}
+	return data
+}
+
+func (p *pageTemplates) writeProjectPage(w io.Writer, data pageData) error {
+	return p.render(w, "project.html", data)
+}
+
+// baseURL returns the URL clients reach pypihub at, as seen by the client making req
+func (r *Router) baseURL(req *http.Request) string {
+	var scheme = "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	var host = req.Host
+
+	var remote, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if ip := net.ParseIP(remote); ip != nil && r.trustedProxy(ip) {
+		if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := req.Header.Get("X-Forwarded-Host"); h != "" {
+			host = h
+		}
+	}
+	return scheme + "://" + host
+}
+
+func (r *Router) repoLink(owner string, repo string) string {
+	return fmt.Sprintf("/%s/%s/", owner, repo)
+}
+
+// projectPageLink returns the link to the page of a project, the packages of
+// monorepos are told apart with a project query parameter
+func (r *Router) projectPageLink(owner string, repo string, project string) string {
+	if project == normalizeProjectName(repo) {
+		return r.repoLink(owner, repo)
+	}
+	return r.repoLink(owner, repo) + "?project=" + url.QueryEscape(project)
+}
+
+func (r *Router) writeProjects(w http.ResponseWriter, req *http.Request, title string, heading string, assets []Asset) {
+	var query = req.URL.Query().Get("q")
+	var projects = projectSummaries(assets, r.syncer.Releases(), query, r.projectPageLink)
+	if query != "" {
+		var matched = make(map[string]bool)
+		for _, p := range projects {
+			matched[repoOf(p.Owner, p.Repo)+"#"+p.Name] = true
+		}
+		assets = filterAssets(assets, func(a Asset) bool {
+			return matched[repoOf(a.Owner, a.Repo)+"#"+projectName(a)]
+		})
+	}
+	r.writePage(w, req, func(w io.Writer) error {
+		return r.pages.writeProjectsPage(w, title, heading, "/", true, query, projects, assets, r.assetLink, r.stylesheet())
+	})
+}
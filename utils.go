@@ -22,3 +22,11 @@ func removeEmpty(s []string) []string {
 	}
 	return n
 }
+
+// stringValue returns the string s points to, or "" when it is nil
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,69 @@
+package pypihub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/brettlangdon/pypihub/pep440"
+)
+
+const (
+	// VersionFromTag derives versions from the git tag of a release
+	VersionFromTag = "tag"
+	// VersionFromName derives versions from the title of a release
+	VersionFromName = "name"
+)
+
+// versionRule is how the versions of a repo are derived from its tags, or
+// release names
+type versionRule struct {
+	// from is VersionFromTag or VersionFromName, repos without releases
+	// always use their tags
+	from string
+	// prefix is stripped from the start of tags and names
+	prefix string
+	// pattern, when set, must match what is left after stripping prefix,
+	// its 'version' group being the version
+	pattern *regexp.Regexp
+}
+
+var defaultVersionRule = versionRule{from: VersionFromTag, prefix: "v"}
+
+func parseVersionFrom(from string) (string, error) {
+	switch from {
+	case "":
+		return VersionFromTag, nil
+	case VersionFromTag, VersionFromName:
+		return from, nil
+	default:
+		return "", fmt.Errorf("unknown version source %q, expected %q or %q", from, VersionFromTag, VersionFromName)
+	}
+}
+
+func parseTagPattern(pattern string) (*regexp.Regexp, error) {
+	var re, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("version") < 0 {
+		return nil, fmt.Errorf("%q has no (?P<version>...) group", pattern)
+	}
+	return re, nil
+}
+
+// errNoVersion is returned for tags and names which don't match a repo's pattern
+var errNoVersion = fmt.Errorf("doesn't match the tag pattern")
+
+// version returns the PEP 440 normalized version for the tag or release name s
+func (r versionRule) version(s string) (string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), r.prefix)
+	if r.pattern != nil {
+		var m = r.pattern.FindStringSubmatch(s)
+		if m == nil {
+			return "", errNoVersion
+		}
+		s = m[r.pattern.SubexpIndex("version")]
+	}
+	return pep440.Normalize(s)
+}